@@ -30,7 +30,8 @@ type Styles struct {
 	Warn,
 	Wrap,
 	Disabled,
-	Enabled pretty.Style
+	Enabled,
+	QRCode pretty.Style
 }
 
 var (
@@ -161,6 +162,10 @@ func init() {
 		Enabled: pretty.Style{
 			pretty.FgColor(Green),
 		},
+		QRCode: pretty.Style{
+			pretty.FgColor(color.Color("#FFFFFF")),
+			pretty.BgColor(color.Color("#000000")),
+		},
 	}
 
 	DefaultStyles.FocusedPrompt = append(
@@ -0,0 +1,45 @@
+package cliui
+
+import (
+	"strings"
+
+	"github.com/coder/pretty"
+	"rsc.io/qr"
+)
+
+// QRCode renders s as a QR code for display in a terminal. Each line of text
+// holds two rows of modules using half blocks.
+func QRCode(s string) (string, error) {
+	code, err := qr.Encode(s, qr.M)
+	if err != nil {
+		return "", err
+	}
+
+	// Scanners need a light border of 4 modules around the code.
+	const quiet = 4
+	var sb strings.Builder
+	for y := -quiet; y < code.Size+quiet; y += 2 {
+		var line strings.Builder
+		for x := -quiet; x < code.Size+quiet; x++ {
+			// Blocks are drawn in the light color, so that codes are still
+			// scannable on dark terminals without color support.
+			top, bottom := !code.Black(x, y), !code.Black(x, y+1)
+			if y+1 >= code.Size+quiet {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				line.WriteString("█")
+			case top:
+				line.WriteString("▀")
+			case bottom:
+				line.WriteString("▄")
+			default:
+				line.WriteString(" ")
+			}
+		}
+		sb.WriteString(pretty.Sprint(DefaultStyles.QRCode, line.String()))
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
@@ -12,6 +12,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"syscall/js"
 	"time"
@@ -24,6 +25,7 @@ import (
 	"golang.org/x/xerrors"
 	"tailscale.com/ipn/store"
 	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
@@ -104,6 +106,8 @@ func newWush(cfg js.Value) map[string]any {
 	if err != nil {
 		panic(err)
 	}
+	// Peers only need to reach the file transfer server.
+	s.SetPacketFilter(tsserver.FilterAllowTCPPorts([]netip.Addr{ov.SelfIP}, tailcfg.PortRange{First: 4444, Last: 4444}))
 
 	go ov.ListenOverlayDERP(ctx)
 	go s.ListenAndServe(ctx)
@@ -144,11 +148,17 @@ func newWush(cfg js.Value) map[string]any {
 				return nil
 			}
 
+			authKey, err := ov.ClientAuth().AuthKey()
+			if err != nil {
+				log.Printf("failed to encode auth key: %s", err)
+				return nil
+			}
+
 			return map[string]any{
 				"derp_id":      ov.DerpRegionID,
 				"derp_name":    ov.DerpMap.Regions[int(ov.DerpRegionID)].RegionName,
 				"derp_latency": ov.DerpLatency.Milliseconds(),
-				"auth_key":     ov.ClientAuth().AuthKey(),
+				"auth_key":     authKey,
 			}
 		}),
 		"stop": js.FuncOf(func(this js.Value, args []js.Value) any {
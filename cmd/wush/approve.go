@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/key"
+
+	"github.com/coder/pretty"
+	"github.com/coder/wush/cliui"
+	"github.com/coder/wush/overlay"
+)
+
+// trustedClients are the client identities serve --approve accepts without
+// prompting. They are persisted one per line as "<identity key> <user@host>".
+type trustedClients struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[key.NodePublic]string
+}
+
+func loadTrustedClients(path string) (*trustedClients, error) {
+	tc := &trustedClients{
+		path: path,
+		keys: map[key.NodePublic]string{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return tc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read trusted clients: %w", err)
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var pub key.NodePublic
+		if err := pub.UnmarshalText([]byte(fields[0])); err != nil {
+			return nil, fmt.Errorf("parse trusted clients line %d: %w", i+1, err)
+		}
+		tc.keys[pub] = strings.Join(fields[1:], " ")
+	}
+	return tc, nil
+}
+
+func (tc *trustedClients) has(pub key.NodePublic) bool {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	_, ok := tc.keys[pub]
+	return ok
+}
+
+func (tc *trustedClients) add(pub key.NodePublic, name string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(tc.path), 0o700)
+	if err != nil {
+		return fmt.Errorf("create trusted clients dir: %w", err)
+	}
+	fi, err := os.OpenFile(tc.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open trusted clients: %w", err)
+	}
+	defer fi.Close()
+
+	text, err := pub.MarshalText()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fi, "%s %s\n", text, name)
+	if err != nil {
+		return fmt.Errorf("write trusted clients: %w", err)
+	}
+
+	tc.keys[pub] = name
+	return nil
+}
+
+// defaultTrustedClientsPath keeps the trusted clients next to the rest of the
+// serve state, falling back to the user config dir.
+func defaultTrustedClientsPath(stateDir string) (string, error) {
+	if stateDir != "" {
+		return filepath.Join(stateDir, "trusted_clients"), nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("get user config dir: %w", err)
+	}
+	return filepath.Join(dir, "wush", "trusted_clients"), nil
+}
+
+// serveConsole reads lines typed into a running wush serve. While a connection
+// request is waiting for approval, the next line answers it. Otherwise lines
+// are handled as commands.
+type serveConsole struct {
+	hlog func(format string, args ...any)
+
+	mu     sync.Mutex
+	answer chan string
+	// promptMu ensures only a single approval prompt is shown at once.
+	promptMu sync.Mutex
+	closed   chan struct{}
+}
+
+func newServeConsole(hlog func(format string, args ...any)) *serveConsole {
+	return &serveConsole{
+		hlog:   hlog,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *serveConsole) run(in io.Reader, handle func(args []string)) {
+	defer close(c.closed)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		c.mu.Lock()
+		answer := c.answer
+		c.answer = nil
+		c.mu.Unlock()
+		if answer != nil {
+			answer <- scanner.Text()
+			continue
+		}
+
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		handle(args)
+	}
+}
+
+// ask prints prompt and waits for the next line. It returns an empty string if
+// the input is closed.
+func (c *serveConsole) ask(prompt string) string {
+	c.promptMu.Lock()
+	defer c.promptMu.Unlock()
+
+	answer := make(chan string, 1)
+	c.mu.Lock()
+	c.answer = answer
+	c.mu.Unlock()
+
+	c.hlog(prompt)
+	select {
+	case line := <-answer:
+		return strings.TrimSpace(line)
+	case <-c.closed:
+		return ""
+	}
+}
+
+// approveConnection returns the approval func used by serve --approve.
+// Trusted clients are accepted automatically, everyone else is prompted for on
+// the console. If console is nil, only trusted clients are accepted.
+func approveConnection(tc *trustedClients, console *serveConsole, hlog func(format string, args ...any)) func(overlay.ConnectionRequest) bool {
+	return func(req overlay.ConnectionRequest) bool {
+		peer := req.HostInfo.String()
+		if !req.Identity.IsZero() && tc.has(req.Identity) {
+			hlog("%s Approved trusted client %s", cliui.Timestamp(time.Now()), cliui.Keyword(peer))
+			return true
+		}
+
+		if console == nil {
+			hlog(pretty.Sprint(cliui.DefaultStyles.Warn, fmt.Sprintf("Denied %s; it is not a trusted client and stdin is not a terminal", peer)))
+			return false
+		}
+
+		choices := "[y/N]"
+		fingerprint := "unverified, no identity key"
+		if !req.Identity.IsZero() {
+			choices = "[y/a(lways)/N]"
+			fingerprint = "fingerprint " + overlay.Fingerprint(req.Identity)
+		}
+		answer := console.ask(fmt.Sprintf("%s Allow %s (%s) with key %s? %s",
+			cliui.Timestamp(time.Now()),
+			cliui.Keyword(peer),
+			fingerprint,
+			cliui.Code(req.KeyLabel),
+			choices,
+		))
+
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return true
+		case "a", "always":
+			if req.Identity.IsZero() {
+				return false
+			}
+			err := tc.add(req.Identity, peer)
+			if err != nil {
+				hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to save trusted client: "+err.Error()))
+			}
+			return true
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"tailscale.com/types/key"
+	"tailscale.com/types/ptr"
+)
+
+func TestLoadTrustedClients(t *testing.T) {
+	alice, bob := key.NewNode().Public(), key.NewNode().Public()
+	aliceText, _ := alice.MarshalText()
+	bobText, _ := bob.MarshalText()
+
+	for _, tc := range []struct {
+		name    string
+		data    *string
+		want    map[key.NodePublic]string
+		wantErr bool
+	}{
+		{name: "Missing", want: map[key.NodePublic]string{}},
+		{name: "Empty", data: ptr.To(""), want: map[key.NodePublic]string{}},
+		{
+			name: "Clients",
+			data: ptr.To(fmt.Sprintf("# trusted\n\n%s alice@laptop\n  %s  \n", aliceText, bobText)),
+			want: map[key.NodePublic]string{alice: "alice@laptop", bob: ""},
+		},
+		{name: "InvalidKey", data: ptr.To("nodekey:zz alice@laptop\n"), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "trusted_clients")
+			if tc.data != nil {
+				if err := os.WriteFile(path, []byte(*tc.data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := loadTrustedClients(path)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.keys, tc.want) {
+				t.Fatalf("got clients %v, want %v", got.keys, tc.want)
+			}
+		})
+	}
+}
+
+func TestTrustedClientsAdd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wush", "trusted_clients")
+	tc, err := loadTrustedClients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := key.NewNode().Public()
+	if err := tc.add(alice, "alice@laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if !tc.has(alice) {
+		t.Fatal("added client isn't trusted")
+	}
+
+	reloaded, err := loadTrustedClients(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.has(alice) || reloaded.keys[alice] != "alice@laptop" {
+		t.Fatalf("added client wasn't saved, got %v", reloaded.keys)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,10 +10,8 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/netip"
-	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/charmbracelet/huh"
@@ -47,7 +46,7 @@ func initLogger(verbose, quiet *bool, slogger *slog.Logger, logf *func(str strin
 	}
 }
 
-func initAuth(authFlag *string, ca *overlay.ClientAuth) serpent.MiddlewareFunc {
+func initAuth(authFlag *string, ca *overlay.ClientAuth, scope overlay.Scope) serpent.MiddlewareFunc {
 	return func(next serpent.HandlerFunc) serpent.HandlerFunc {
 		return func(i *serpent.Invocation) error {
 			if *authFlag == "" {
@@ -60,15 +59,46 @@ func initAuth(authFlag *string, ca *overlay.ClientAuth) serpent.MiddlewareFunc {
 				}
 			}
 
-			// If the user provided a URL, extract the auth key from the fragment.
-			authKey := *authFlag
-			if u, err := url.Parse(*authFlag); err == nil && u.Fragment != "" {
-				authKey = u.Fragment
+			err := parseAuthKey(*authFlag, ca)
+			if err != nil {
+				return err
+			}
+
+			err = ca.Authorize(scope, 0)
+			if err != nil {
+				return err
+			}
+
+			return next(i)
+		}
+	}
+}
+
+// initCode redeems a pairing code printed by wush serve --code for the full
+// auth key, which is then parsed by initAuth.
+func initCode(codeFlag, authFlag, derpmapFi *string, dm *tailcfg.DERPMap, logf *func(str string, args ...any)) serpent.MiddlewareFunc {
+	return func(next serpent.HandlerFunc) serpent.HandlerFunc {
+		return func(i *serpent.Invocation) error {
+			if *codeFlag == "" {
+				return next(i)
+			}
+			if *authFlag != "" {
+				return errors.New("only one of --code and --auth-key may be provided")
+			}
+
+			code, err := overlay.ParsePairingCode(*codeFlag)
+			if err != nil {
+				return fmt.Errorf("parse pairing code: %w", err)
 			}
 
-			err := ca.Parse(strings.TrimSpace(authKey))
+			err = requireDERPMap(i.Context(), *derpmapFi, dm)
+			if err != nil {
+				return err
+			}
+			(*logf)("Redeeming pairing code %s..", cliui.Code(code.String()))
+			*authFlag, err = overlay.RedeemPairingCode(i.Context(), dm, code)
 			if err != nil {
-				return fmt.Errorf("parse auth key: %w", err)
+				return fmt.Errorf("redeem pairing code: %w", err)
 			}
 
 			return next(i)
@@ -76,13 +106,25 @@ func initAuth(authFlag *string, ca *overlay.ClientAuth) serpent.MiddlewareFunc {
 	}
 }
 
-func sendOverlayMW(opts *sendOverlayOpts, send **overlay.Send, logger *slog.Logger, dm *tailcfg.DERPMap, logf *func(str string, args ...any)) serpent.MiddlewareFunc {
+func sendOverlayMW(opts *sendOverlayOpts, send **overlay.Send, logger *slog.Logger, derpmapFi *string, dm *tailcfg.DERPMap, logf *func(str string, args ...any)) serpent.MiddlewareFunc {
 	return func(next serpent.HandlerFunc) serpent.HandlerFunc {
 		return func(i *serpent.Invocation) error {
 			var err error
 
-			newSend := overlay.NewSendOverlay(logger, dm)
-			newSend.Auth = opts.clientAuth
+			// Receivers using a self-hosted DERP map send it in the auth key.
+			if opts.clientAuth.DERPMap != nil {
+				*dm = *opts.clientAuth.DERPMap
+			} else if opts.clientAuth.ReceiverDERPRegionID != 0 {
+				err = requireDERPMap(i.Context(), *derpmapFi, dm)
+				if err != nil {
+					return err
+				}
+			}
+
+			newSend := overlay.NewSendOverlay(logger, dm, opts.clientAuth)
+			newSend.OnReconnect = logReconnect(func(str string, args ...any) {
+				(*logf)(str, args...)
+			})
 			if opts.stunAddrOverride != "" {
 				newSend.STUNIPOverride, err = netip.ParseAddr(opts.stunAddrOverride)
 				if err != nil {
@@ -90,40 +132,118 @@ func sendOverlayMW(opts *sendOverlayOpts, send **overlay.Send, logger *slog.Logg
 				}
 			}
 
+			identityPath, err := overlay.DefaultIdentityPath()
+			if err == nil {
+				newSend.Identity, err = overlay.LoadOrCreateIdentity(identityPath)
+			}
+			if err != nil {
+				// Receivers that don't require approval don't need an identity.
+				(*logf)("Failed to load client identity: %s", err)
+			} else {
+				(*logf)("Client identity fingerprint: %s", cliui.Code(overlay.Fingerprint(newSend.Identity.Public())))
+			}
+
 			newSend.Auth.PrintDebug(*logf, dm)
 
 			*send = newSend
+			// Let the receiver remove us right away, instead of once our
+			// pings stop.
+			defer newSend.Goodbye()
 			return next(i)
 		}
 	}
 }
 
+// listenSendOverlay connects the send overlay to the receiver over every
+// overlay in the auth key. The returned context is cancelled if the receiver
+// denies the connection or speaks an incompatible protocol.
+func listenSendOverlay(ctx context.Context, send *overlay.Send) (context.Context, error) {
+	if send.Auth.ReceiverDERPRegionID == 0 && !send.Auth.ReceiverStunAddr.IsValid() && !send.Auth.ReceiverLAN {
+		return nil, errors.New("auth key provided no overlays")
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		err := send.ListenOverlay(ctx)
+		if errors.Is(err, overlay.ErrDenied) || errors.Is(err, overlay.ErrIncompatible) {
+			cancel(err)
+		}
+	}()
+	return ctx, nil
+}
+
+// logReconnect reports overlays going down and coming back with logf.
+func logReconnect(logf func(str string, args ...any)) func(overlay.ReconnectEvent) {
+	return func(ev overlay.ReconnectEvent) {
+		if ev.Err == nil {
+			logf("%s Reconnected over %s", cliui.Timestamp(time.Now()), ev.Overlay)
+			return
+		}
+		logf("%s Overlay %s is down, retrying in %s (attempt %d): %s",
+			cliui.Timestamp(time.Now()), ev.Overlay, ev.RetryIn.Round(100*time.Millisecond), ev.Attempt, ev.Err)
+	}
+}
+
+// derpMap loads the DERP map from fi, if set. Otherwise dm is left empty until
+// requireDERPMap is called, so peers that don't use DERP never contact
+// Tailscale.
 func derpMap(fi *string, dm *tailcfg.DERPMap) serpent.MiddlewareFunc {
 	return func(next serpent.HandlerFunc) serpent.HandlerFunc {
 		return func(i *serpent.Invocation) error {
 			if *fi == "" {
-				_dm, err := tsserver.DERPMapTailscale(i.Context())
-				if err != nil {
-					return fmt.Errorf("request derpmap from tailscale: %w", err)
-				}
-				*dm = *_dm
-			} else {
-				data, err := os.ReadFile(*fi)
-				if err != nil {
-					return fmt.Errorf("read derp config file: %w", err)
-				}
-				if err := json.Unmarshal(data, dm); err != nil {
-					return fmt.Errorf("unmarshal derp config: %w", err)
-				}
+				return next(i)
 			}
+			_dm, err := loadDERPMap(i.Context(), *fi)
+			if err != nil {
+				return err
+			}
+			*dm = *_dm
 
 			return next(i)
 		}
 	}
 }
 
+// requireDERPMap requests Tailscale's DERP map into dm, unless one was loaded
+// from fi or has already been requested.
+func requireDERPMap(ctx context.Context, fi string, dm *tailcfg.DERPMap) error {
+	if fi != "" || len(dm.Regions) > 0 {
+		return nil
+	}
+
+	_dm, err := loadDERPMap(ctx, "")
+	if err != nil {
+		return err
+	}
+	*dm = *_dm
+	return nil
+}
+
+// loadDERPMap reads the DERP map from fi, or requests Tailscale's if fi is
+// empty.
+func loadDERPMap(ctx context.Context, fi string) (*tailcfg.DERPMap, error) {
+	if fi == "" {
+		dm, err := tsserver.DERPMapTailscale(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("request derpmap from tailscale: %w", err)
+		}
+		return dm, nil
+	}
+
+	data, err := os.ReadFile(fi)
+	if err != nil {
+		return nil, fmt.Errorf("read derp config file: %w", err)
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(data, dm); err != nil {
+		return nil, fmt.Errorf("unmarshal derp config: %w", err)
+	}
+	return dm, nil
+}
+
 type sendOverlayOpts struct {
 	authKey          string
+	code             string
 	clientAuth       overlay.ClientAuth
 	waitP2P          bool
 	stunAddrOverride string
@@ -152,9 +272,10 @@ func cpCmd() *serpent.Command {
 		Middleware: serpent.Chain(
 			serpent.RequireNArgs(1),
 			initLogger(&verbose, ptr.To(false), logger, &logf),
-			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth),
 			derpMap(&derpmapFi, dm),
-			sendOverlayMW(overlayOpts, &send, logger, dm, &logf),
+			initCode(&overlayOpts.code, &overlayOpts.authKey, &derpmapFi, dm, &logf),
+			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth, overlay.ScopeCp),
+			sendOverlayMW(overlayOpts, &send, logger, &derpmapFi, dm, &logf),
 		),
 		Handler: func(inv *serpent.Invocation) error {
 			ctx := inv.Context()
@@ -163,13 +284,13 @@ func cpCmd() *serpent.Command {
 			if err != nil {
 				return err
 			}
+			// Nothing connects to us, so the receiver can't reach our
+			// node.
+			s.SetPacketFilter(tsserver.FilterAllowTCPPorts(nil))
 
-			if send.Auth.ReceiverDERPRegionID != 0 {
-				go send.ListenOverlayDERP(ctx)
-			} else if send.Auth.ReceiverStunAddr.IsValid() {
-				go send.ListenOverlaySTUN(ctx)
-			} else {
-				return errors.New("auth key provided neither DERP nor STUN")
+			ctx, err = listenSendOverlay(ctx, send)
+			if err != nil {
+				return err
 			}
 
 			go s.ListenAndServe(ctx)
@@ -262,13 +383,13 @@ func cpCmd() *serpent.Command {
 			}
 
 			netns.SetDialerOverride(s.Dialer())
-			ts, err := newTSNet("send", verbose)
+			ts, err := newTSNet("send", verbose, "")
 			if err != nil {
 				return err
 			}
 
 			logf("Bringing WireGuard up..")
-			ts.Up(ctx)
+			upTSNet(ctx, ts, dm)
 			logf("WireGuard is ready!")
 
 			lc, err := ts.LocalClient()
@@ -276,13 +397,13 @@ func cpCmd() *serpent.Command {
 				return err
 			}
 
-			ip, err := waitUntilHasPeerHasIP(ctx, logf, lc)
+			ip, err := waitUntilHasPeerHasIP(ctx, logf, lc, dm)
 			if err != nil {
 				return err
 			}
 
 			if overlayOpts.waitP2P {
-				err := waitUntilHasP2P(ctx, logf, lc)
+				err := waitUntilHasP2P(ctx, logf, lc, dm)
 				if err != nil {
 					return err
 				}
@@ -295,7 +416,7 @@ func cpCmd() *serpent.Command {
 			barReader := progressbar.NewReader(fi, bar)
 
 			hc := ts.HTTPClient()
-			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s:4444/%s", ip.String(), fiName), &barReader)
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s/%s", netip.AddrPortFrom(ip, 4444), fiName), &barReader)
 			if err != nil {
 				return err
 			}
@@ -324,6 +445,13 @@ func cpCmd() *serpent.Command {
 				Default:     "",
 				Value:       serpent.StringOf(&overlayOpts.authKey),
 			},
+			{
+				Flag:        "code",
+				Env:         "WUSH_CODE",
+				Description: "A pairing code printed by " + cliui.Code("wush serve --code") + ". Can be used instead of --auth-key.",
+				Default:     "",
+				Value:       serpent.StringOf(&overlayOpts.code),
+			},
 			{
 				Flag:        "derp-config-file",
 				Description: "File which specifies the DERP config to use. In the structure of https://pkg.go.dev/tailscale.com@v1.74.1/tailcfg#DERPMap. By default, https://controlplane.tailscale.com/derpmap/default is used.",
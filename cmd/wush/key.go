@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coder/pretty"
+	"github.com/coder/serpent"
+	"rsc.io/qr"
+	"tailscale.com/tailcfg"
+
+	"github.com/coder/wush/cliui"
+	"github.com/coder/wush/overlay"
+)
+
+// parseAuthKey parses an auth key, or a wush.dev URL with the key in its
+// fragment.
+func parseAuthKey(in string, ca *overlay.ClientAuth) error {
+	authKey := in
+	if u, err := url.Parse(in); err == nil && u.Fragment != "" {
+		authKey = u.Fragment
+	}
+
+	err := ca.Parse(strings.TrimSpace(authKey))
+	if err != nil {
+		return fmt.Errorf("parse auth key: %w", err)
+	}
+	return nil
+}
+
+// authKeyURL is the link that opens a connection to the receiver of authKey
+// in the browser.
+func authKeyURL(authKey string) string {
+	return "https://wush.dev#" + authKey
+}
+
+// writeQRFile writes s as a QR code PNG to path.
+func writeQRFile(path, s string) error {
+	code, err := qr.Encode(s, qr.M)
+	if err != nil {
+		return fmt.Errorf("encode QR code: %w", err)
+	}
+
+	fi, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("create QR code file: %w", err)
+	}
+	defer fi.Close()
+
+	code.Scale = 8
+	_, err = fi.Write(code.PNG())
+	if err != nil {
+		return fmt.Errorf("write QR code file: %w", err)
+	}
+	return fi.Close()
+}
+
+// keyDERPMap returns the DERP map the key's DERP region refers to: either the
+// self-hosted map embedded in the key, the map in fi, or Tailscale's.
+func keyDERPMap(ctx context.Context, ca *overlay.ClientAuth, fi string) (*tailcfg.DERPMap, error) {
+	if ca.DERPMap != nil {
+		return ca.DERPMap, nil
+	}
+
+	return loadDERPMap(ctx, fi)
+}
+
+func keyCmd() *serpent.Command {
+	return &serpent.Command{
+		Use:   "key",
+		Short: "Inspect and check auth keys.",
+		Handler: func(inv *serpent.Invocation) error {
+			return serpent.DefaultHelpFn()(inv)
+		},
+		Children: []*serpent.Command{
+			keyInspectCmd(),
+			keyCheckCmd(),
+			keyQRCmd(),
+		},
+	}
+}
+
+// keyInfo is everything encoded in an auth key, except for the private key.
+type keyInfo struct {
+	Version             int        `json:"version"`
+	Web                 bool       `json:"web"`
+	STUNAddr            string     `json:"stun_addr,omitempty"`
+	DERPRegionID        uint16     `json:"derp_region_id,omitempty"`
+	DERPRegionName      string     `json:"derp_region_name,omitempty"`
+	LAN                 bool       `json:"lan"`
+	SelfHostedDERP      bool       `json:"self_hosted_derp"`
+	DERPSecret          bool       `json:"derp_secret"`
+	ReceiverPublicKey   string     `json:"receiver_public_key"`
+	ReceiverFingerprint string     `json:"receiver_fingerprint"`
+	OverlayPublicKey    string     `json:"overlay_public_key"`
+	OverlayFingerprint  string     `json:"overlay_fingerprint"`
+	Expiry              *time.Time `json:"expiry,omitempty"`
+	Expired             bool       `json:"expired"`
+	Scope               []string   `json:"scope"`
+	Ports               []uint16   `json:"ports,omitempty"`
+}
+
+func newKeyInfo(ca *overlay.ClientAuth, dm *tailcfg.DERPMap) keyInfo {
+	overlayPub := ca.OverlayPrivateKey.Public()
+	info := keyInfo{
+		Version:             ca.Version(),
+		Web:                 ca.Web,
+		DERPRegionID:        ca.ReceiverDERPRegionID,
+		LAN:                 ca.ReceiverLAN,
+		SelfHostedDERP:      ca.DERPMap != nil,
+		DERPSecret:          ca.DERPSecret != "",
+		ReceiverPublicKey:   ca.ReceiverPublicKey.String(),
+		ReceiverFingerprint: overlay.Fingerprint(ca.ReceiverPublicKey),
+		OverlayPublicKey:    overlayPub.String(),
+		OverlayFingerprint:  overlay.Fingerprint(overlayPub),
+		Expired:             ca.Expired(),
+		Scope:               []string{},
+		Ports:               ca.Ports,
+	}
+	if ca.ReceiverStunAddr.IsValid() {
+		info.STUNAddr = ca.ReceiverStunAddr.String()
+	}
+	if dm != nil {
+		if region := dm.Regions[int(ca.ReceiverDERPRegionID)]; region != nil {
+			info.DERPRegionName = region.RegionName
+		}
+	}
+	if !ca.Expiry.IsZero() {
+		info.Expiry = &ca.Expiry
+	}
+	if ca.Scope != 0 {
+		info.Scope = strings.Split(ca.Scope.String(), ",")
+	}
+	return info
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func keyInspectCmd() *serpent.Command {
+	var (
+		jsonOut   bool
+		derpmapFi string
+	)
+	return &serpent.Command{
+		Use:   "inspect <key|url>",
+		Short: "Decode an auth key.",
+		Long: formatExamples(
+			example{
+				Description: "Show what an auth key grants access to",
+				Command:     "wush key inspect 112v1RyL5KPzsbMbhT7fkEGrcfpygxtnvwjR5kMLGxDHGeLTK1BvoPqsUcjo7xyMkFn46KLTdedKuPCG5trP84mz9kx",
+			},
+		),
+		Middleware: serpent.RequireNArgs(1),
+		Handler: func(inv *serpent.Invocation) error {
+			var ca overlay.ClientAuth
+			err := parseAuthKey(inv.Args[0], &ca)
+			if err != nil {
+				return err
+			}
+
+			// The region name is nice to have, but inspecting a key shouldn't
+			// fail because Tailscale's DERP map couldn't be fetched.
+			dm, err := keyDERPMap(inv.Context(), &ca, derpmapFi)
+			if err != nil && !jsonOut {
+				fmt.Fprintln(inv.Stderr, pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to get DERP map: "+err.Error()))
+			}
+			info := newKeyInfo(&ca, dm)
+
+			if jsonOut {
+				return writeJSON(inv.Stdout, info)
+			}
+
+			orDisabled := func(s string) string {
+				if s == "" {
+					return "Disabled"
+				}
+				return s
+			}
+			derpStr := ""
+			if info.DERPRegionID != 0 {
+				derpStr = fmt.Sprintf("%d", info.DERPRegionID)
+				if info.DERPRegionName != "" {
+					derpStr = fmt.Sprintf("%s (%d)", info.DERPRegionName, info.DERPRegionID)
+				}
+				if info.SelfHostedDERP {
+					derpStr += ", self-hosted"
+				}
+				if info.DERPSecret {
+					derpStr += ", requires secret"
+				}
+			}
+			lanStr := ""
+			if info.LAN {
+				lanStr = "Enabled"
+			}
+			expiryStr := "Never"
+			if info.Expiry != nil {
+				expiryStr = info.Expiry.Format(time.RFC1123)
+				if info.Expired {
+					expiryStr += " " + pretty.Sprint(cliui.DefaultStyles.Warn, "(expired)")
+				}
+			}
+
+			w := inv.Stdout
+			fmt.Fprintf(w, "Version:              %d\n", info.Version)
+			fmt.Fprintf(w, "Web:                  %t\n", info.Web)
+			fmt.Fprintf(w, "STUN address:         %s\n", cliui.Code(orDisabled(info.STUNAddr)))
+			fmt.Fprintf(w, "DERP region:          %s\n", cliui.Code(orDisabled(derpStr)))
+			fmt.Fprintf(w, "LAN discovery:        %s\n", cliui.Code(orDisabled(lanStr)))
+			fmt.Fprintf(w, "Receiver public key:  %s (%s)\n", cliui.Code(ca.ReceiverPublicKey.ShortString()), info.ReceiverFingerprint)
+			fmt.Fprintf(w, "Overlay public key:   %s (%s)\n", cliui.Code(ca.OverlayPrivateKey.Public().ShortString()), info.OverlayFingerprint)
+			fmt.Fprintf(w, "Expiry:               %s\n", expiryStr)
+			fmt.Fprintf(w, "Scope:                %s\n", cliui.Code(ca.Scope.String()))
+			if len(info.Ports) > 0 {
+				ports := make([]string, len(info.Ports))
+				for i, port := range info.Ports {
+					ports[i] = fmt.Sprint(port)
+				}
+				fmt.Fprintf(w, "Allowed ports:        %s\n", cliui.Code(strings.Join(ports, ",")))
+			}
+			return nil
+		},
+		Options: []serpent.Option{
+			{
+				Flag:        "json",
+				Description: "Output as JSON.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&jsonOut),
+			},
+			{
+				Flag:        "derp-config-file",
+				Description: "File which specifies the DERP config to look up the region name in. Not needed for keys from a self-hosted DERP map.",
+				Default:     "",
+				Value:       serpent.StringOf(&derpmapFi),
+			},
+		},
+	}
+}
+
+// keyCheckResult is the outcome of probing a single overlay.
+type keyCheckResult struct {
+	Overlay        string  `json:"overlay"`
+	Target         string  `json:"target"`
+	OK             bool    `json:"ok"`
+	RelayLatencyMS float64 `json:"relay_latency_ms,omitempty"`
+	ReceiverRTTMS  float64 `json:"receiver_rtt_ms,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+func newKeyCheckResult(name, target string, res overlay.ProbeResult, err error) keyCheckResult {
+	kr := keyCheckResult{
+		Overlay:        name,
+		Target:         target,
+		OK:             err == nil,
+		RelayLatencyMS: float64(res.RelayLatency.Microseconds()) / 1000,
+		ReceiverRTTMS:  float64(res.ReceiverRTT.Microseconds()) / 1000,
+	}
+	if err != nil {
+		kr.Error = err.Error()
+	}
+	return kr
+}
+
+func keyCheckCmd() *serpent.Command {
+	var (
+		jsonOut   bool
+		derpmapFi string
+		timeout   time.Duration
+	)
+	return &serpent.Command{
+		Use:   "check <key|url>",
+		Short: "Check that the receiver of an auth key is reachable.",
+		Long: "Connects to the DERP region and STUN address in the key, and looks for the receiver on the " +
+			"local network if the key allows it, then pings the receiver over each of them. " +
+			"Exits non-zero if the receiver can't be reached over any overlay.",
+		Middleware: serpent.RequireNArgs(1),
+		Handler: func(inv *serpent.Invocation) error {
+			var ca overlay.ClientAuth
+			err := parseAuthKey(inv.Args[0], &ca)
+			if err != nil {
+				return err
+			}
+			if ca.ReceiverDERPRegionID == 0 && !ca.ReceiverStunAddr.IsValid() && !ca.ReceiverLAN {
+				return errors.New("auth key provided no overlays")
+			}
+
+			results := []keyCheckResult{}
+			if ca.ReceiverDERPRegionID != 0 {
+				dm, err := keyDERPMap(inv.Context(), &ca, derpmapFi)
+				if err != nil {
+					return err
+				}
+				target := fmt.Sprint(ca.ReceiverDERPRegionID)
+				if region := dm.Regions[int(ca.ReceiverDERPRegionID)]; region != nil {
+					target = region.RegionName
+				}
+
+				ctx, cancel := context.WithTimeout(inv.Context(), timeout)
+				res, err := ca.ProbeDERP(ctx, dm)
+				cancel()
+				results = append(results, newKeyCheckResult("derp", target, res, err))
+			}
+			if ca.ReceiverStunAddr.IsValid() {
+				ctx, cancel := context.WithTimeout(inv.Context(), timeout)
+				res, err := ca.ProbeSTUN(ctx)
+				cancel()
+				results = append(results, newKeyCheckResult("stun", ca.ReceiverStunAddr.String(), res, err))
+			}
+			if ca.ReceiverLAN {
+				ctx, cancel := context.WithTimeout(inv.Context(), timeout)
+				res, err := ca.ProbeLAN(ctx)
+				cancel()
+				target := "local network"
+				if res.Addr.IsValid() {
+					target = res.Addr.String()
+				}
+				results = append(results, newKeyCheckResult("lan", target, res, err))
+			}
+
+			ok := false
+			for _, res := range results {
+				ok = ok || res.OK
+			}
+
+			if jsonOut {
+				err := writeJSON(inv.Stdout, results)
+				if err != nil {
+					return err
+				}
+			} else {
+				for _, res := range results {
+					switch {
+					case res.OK && res.RelayLatencyMS > 0:
+						fmt.Fprintf(inv.Stdout, "%s %s: relay %.1fms, receiver %.1fms\n", strings.ToUpper(res.Overlay), cliui.Code(res.Target), res.RelayLatencyMS, res.ReceiverRTTMS)
+					case res.OK:
+						fmt.Fprintf(inv.Stdout, "%s %s: receiver %.1fms\n", strings.ToUpper(res.Overlay), cliui.Code(res.Target), res.ReceiverRTTMS)
+					default:
+						fmt.Fprintf(inv.Stdout, "%s %s: %s\n", strings.ToUpper(res.Overlay), cliui.Code(res.Target), pretty.Sprint(cliui.DefaultStyles.Warn, res.Error))
+					}
+				}
+			}
+
+			if !ok {
+				return errors.New("receiver is unreachable")
+			}
+			return nil
+		},
+		Options: []serpent.Option{
+			{
+				Flag:        "json",
+				Description: "Output as JSON.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&jsonOut),
+			},
+			{
+				Flag:        "derp-config-file",
+				Description: "File which specifies the DERP config to use. Not needed for keys from a self-hosted DERP map.",
+				Default:     "",
+				Value:       serpent.StringOf(&derpmapFi),
+			},
+			{
+				Flag:        "timeout",
+				Description: "How long to wait for the receiver to answer over each overlay.",
+				Default:     "5s",
+				Value:       serpent.DurationOf(&timeout),
+			},
+		},
+	}
+}
+
+func keyQRCmd() *serpent.Command {
+	var (
+		qrFile  string
+		keyOnly bool
+	)
+	return &serpent.Command{
+		Use:   "qr <key|url>",
+		Short: "Show the browser link for an auth key as a QR code.",
+		Long: formatExamples(
+			example{
+				Description: "Save a QR code to share with a phone",
+				Command:     "wush key qr --qr-file wush.png 112v1RyL5KPzsbMbhT7fkEGrcfpygxtnvwjR5kMLGxDHGeLTK1BvoPqsUcjo7xyMkFn46KLTdedKuPCG5trP84mz9kx",
+			},
+		),
+		Middleware: serpent.RequireNArgs(1),
+		Handler: func(inv *serpent.Invocation) error {
+			var ca overlay.ClientAuth
+			err := parseAuthKey(inv.Args[0], &ca)
+			if err != nil {
+				return err
+			}
+
+			authKey, err := ca.AuthKey()
+			if err != nil {
+				return err
+			}
+			content := authKeyURL(authKey)
+			if keyOnly {
+				content = authKey
+			}
+
+			if qrFile != "" {
+				err := writeQRFile(qrFile, content)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(inv.Stderr, "Wrote QR code to %s\n", cliui.Code(qrFile))
+				return nil
+			}
+
+			qr, err := cliui.QRCode(content)
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(inv.Stdout, qr)
+			return nil
+		},
+		Options: []serpent.Option{
+			{
+				Flag:        "qr-file",
+				Description: "Write the QR code to this file as a PNG instead of printing it.",
+				Default:     "",
+				Value:       serpent.StringOf(&qrFile),
+			},
+			{
+				Flag:        "key-only",
+				Description: "Encode the bare auth key instead of the wush.dev link.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&keyOnly),
+			},
+		},
+	}
+}
@@ -52,6 +52,8 @@ func main() {
 			rsyncCmd(),
 			cpCmd(),
 			portForwardCmd(),
+			keyCmd(),
+			relayCmd(),
 		},
 		Options: []serpent.Option{
 			{
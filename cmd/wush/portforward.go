@@ -63,12 +63,17 @@ func portForwardCmd() *serpent.Command {
 				Description: "Forward specifying the local address to bind",
 				Command:     "wush port-forward --tcp 1.2.3.4:8080:8080",
 			},
+			example{
+				Description: "Forward to a local IPv6 address",
+				Command:     "wush port-forward --tcp [::1]:8080:8080",
+			},
 		),
 		Middleware: serpent.Chain(
 			initLogger(&verbose, ptr.To(false), logger, &logf),
-			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth),
 			derpMap(&derpmapFi, dm),
-			sendOverlayMW(overlayOpts, &send, logger, dm, &logf),
+			initCode(&overlayOpts.code, &overlayOpts.authKey, &derpmapFi, dm, &logf),
+			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth, overlay.ScopePortForward),
+			sendOverlayMW(overlayOpts, &send, logger, &derpmapFi, dm, &logf),
 		),
 		Handler: func(inv *serpent.Invocation) error {
 			ctx, cancel := context.WithCancel(inv.Context())
@@ -81,29 +86,35 @@ func portForwardCmd() *serpent.Command {
 			if len(specs) == 0 {
 				return errors.New("no port-forwards requested")
 			}
+			for _, spec := range specs {
+				err := overlayOpts.clientAuth.Authorize(overlay.ScopePortForward, spec.dialAddress.Port())
+				if err != nil {
+					return err
+				}
+			}
 
 			s, err := tsserver.NewServer(ctx, logger, send, dm)
 			if err != nil {
 				return err
 			}
+			// Nothing connects to us, so the receiver can't reach our
+			// node.
+			s.SetPacketFilter(tsserver.FilterAllowTCPPorts(nil))
 
-			if send.Auth.ReceiverDERPRegionID != 0 {
-				go send.ListenOverlayDERP(ctx)
-			} else if send.Auth.ReceiverStunAddr.IsValid() {
-				go send.ListenOverlaySTUN(ctx)
-			} else {
-				return errors.New("auth key provided neither DERP nor STUN")
+			ctx, err = listenSendOverlay(ctx, send)
+			if err != nil {
+				return err
 			}
 
 			go s.ListenAndServe(ctx)
 			netns.SetDialerOverride(s.Dialer())
-			ts, err := newTSNet("send", verbose)
+			ts, err := newTSNet("send", verbose, "")
 			if err != nil {
 				return err
 			}
 
 			logf("Bringing WireGuard up..")
-			ts.Up(ctx)
+			upTSNet(ctx, ts, dm)
 			logf("WireGuard is ready!")
 
 			lc, err := ts.LocalClient()
@@ -111,13 +122,13 @@ func portForwardCmd() *serpent.Command {
 				return err
 			}
 
-			ip, err := waitUntilHasPeerHasIP(ctx, logf, lc)
+			ip, err := waitUntilHasPeerHasIP(ctx, logf, lc, dm)
 			if err != nil {
 				return err
 			}
 
 			if overlayOpts.waitP2P {
-				err := waitUntilHasP2P(ctx, logf, lc)
+				err := waitUntilHasP2P(ctx, logf, lc, dm)
 				if err != nil {
 					return err
 				}
@@ -181,6 +192,13 @@ func portForwardCmd() *serpent.Command {
 				Default:     "",
 				Value:       serpent.StringOf(&overlayOpts.authKey),
 			},
+			{
+				Flag:        "code",
+				Env:         "WUSH_CODE",
+				Description: "A pairing code printed by " + cliui.Code("wush serve --code") + ". Can be used instead of --auth-key.",
+				Default:     "",
+				Value:       serpent.StringOf(&overlayOpts.code),
+			},
 			{
 				Flag:        "derp-config-file",
 				Description: "File which specifies the DERP config to use. In the structure of https://pkg.go.dev/tailscale.com@v1.74.1/tailcfg#DERPMap.",
@@ -361,6 +379,22 @@ func parseSrcDestPorts(in string) ([]parsedSrcDestPort, error) {
 		remoteAddr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
 	)
 
+	// IPv6 local addresses contain colons, so they must be bracketed.
+	if strings.HasPrefix(in, "[") {
+		host, rest, ok := strings.Cut(in[1:], "]:")
+		if !ok {
+			return nil, xerrors.Errorf("invalid port specification %q; missing \"]:\" after ip", in)
+		}
+		_localAddr, err := netip.ParseAddr(host)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid port specification %q; invalid ip %q: %w", in, host, err)
+		}
+		parts = append([]string{_localAddr.String()}, strings.Split(rest, ":")...)
+		if len(parts) == 2 {
+			parts = append(parts, parts[1])
+		}
+	}
+
 	switch len(parts) {
 	case 1:
 		// Duplicate the single part
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/stunserver"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/lru"
+
+	"github.com/coder/serpent"
+	"github.com/coder/wush/cliui"
+	"github.com/coder/wush/overlay"
+)
+
+func relayCmd() *serpent.Command {
+	var (
+		hostname   string
+		addr       string
+		stunPort   int64
+		regionID   int64
+		certFile   string
+		keyFile    string
+		certDir    string
+		secret     string
+		derpmapOut string
+		verbose    bool
+	)
+	return &serpent.Command{
+		Use:   "relay",
+		Short: "Run a DERP relay and STUN server for wush serve --derp-config-file.",
+		Long: formatExamples(
+			example{
+				Description: "Run a relay with a Let's Encrypt certificate, and save its DERP map",
+				Command:     "wush relay --hostname relay.example.com --derp-map-file derp.json",
+			},
+			example{
+				Description: "Use the relay, requiring a shared secret",
+				Command:     "wush serve --derp-config-file derp.json --derp-secret <secret>",
+			},
+		),
+		Handler: func(inv *serpent.Invocation) error {
+			ctx := inv.Context()
+			hlog := func(format string, args ...any) {
+				fmt.Fprintf(inv.Stderr, format+"\n", args...)
+			}
+			logf := func(format string, args ...any) {}
+			if verbose {
+				logf = hlog
+			} else {
+				// The STUN server logs with the standard logger.
+				log.SetOutput(io.Discard)
+			}
+
+			if hostname == "" {
+				return errors.New("--hostname is required, as clients verify the relay's certificate against it")
+			}
+			if (certFile == "") != (keyFile == "") {
+				return errors.New("--cert-file and --key-file must be used together")
+			}
+			if regionID < 1 || regionID > 0xffff {
+				return errors.New("--region-id must be between 1 and 65535")
+			}
+			listenHost, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				return fmt.Errorf("parse listen address: %w", err)
+			}
+			derpPort, err := strconv.Atoi(portStr)
+			if err != nil {
+				return fmt.Errorf("parse listen port: %w", err)
+			}
+
+			s := derp.NewServer(key.NewNode(), logf)
+			defer s.Close()
+
+			mux := http.NewServeMux()
+			mux.Handle("/derp", derphttp.Handler(s))
+			mux.HandleFunc("/derp/probe", derphttp.ProbeHandler)
+			mux.HandleFunc("/derp/latency-check", derphttp.ProbeHandler)
+			mux.HandleFunc("/generate_204", derphttp.ServeNoContent)
+
+			if secret != "" {
+				admission := &relayAdmission{
+					secret: secret,
+					keys:   lru.Cache[key.NodePublic, struct{}]{MaxEntries: maxAdmittedKeys},
+				}
+				mux.HandleFunc(overlay.RelayAdmitPath, admission.admit)
+
+				// The DERP server only asks URLs whether to let clients in.
+				verifyLn, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return fmt.Errorf("listen for DERP client verification: %w", err)
+				}
+				defer verifyLn.Close()
+				go http.Serve(verifyLn, http.HandlerFunc(admission.verify))
+				s.SetVerifyClientURL("http://" + verifyLn.Addr().String())
+			}
+
+			tlsConfig, err := relayTLSConfig(s, hostname, certFile, keyFile, certDir)
+			if err != nil {
+				return err
+			}
+
+			ln, err := net.Listen("tcp", addr)
+			if err != nil {
+				return fmt.Errorf("listen DERP: %w", err)
+			}
+			srv := &http.Server{
+				Handler:   mux,
+				TLSConfig: tlsConfig,
+				// DERP connections are hijacked, so these only apply to
+				// other requests.
+				ReadTimeout:  30 * time.Second,
+				WriteTimeout: 30 * time.Second,
+			}
+			go func() {
+				<-ctx.Done()
+				_ = srv.Close()
+			}()
+
+			dmSTUNPort := int(stunPort)
+			if stunPort > 0 {
+				ss := stunserver.New(ctx)
+				err := ss.Listen(net.JoinHostPort(listenHost, strconv.Itoa(int(stunPort))))
+				if err != nil {
+					return fmt.Errorf("listen STUN: %w", err)
+				}
+				go ss.Serve()
+			} else {
+				dmSTUNPort = -1
+			}
+
+			// Clients default to port 443.
+			if derpPort == 443 {
+				derpPort = 0
+			}
+			dm := &tailcfg.DERPMap{
+				Regions: map[int]*tailcfg.DERPRegion{
+					int(regionID): {
+						RegionID:   int(regionID),
+						RegionCode: "wush",
+						RegionName: hostname,
+						Nodes: []*tailcfg.DERPNode{{
+							Name:     fmt.Sprintf("%da", regionID),
+							RegionID: int(regionID),
+							HostName: hostname,
+							DERPPort: derpPort,
+							STUNPort: dmSTUNPort,
+						}},
+					},
+				},
+				OmitDefaultRegions: true,
+			}
+			dmJSON, err := json.MarshalIndent(dm, "", "  ")
+			if err != nil {
+				return err
+			}
+
+			useStr := "wush serve --derp-config-file "
+			if derpmapOut != "" {
+				err := os.WriteFile(derpmapOut, append(dmJSON, '\n'), 0o644)
+				if err != nil {
+					return fmt.Errorf("write DERP map: %w", err)
+				}
+				hlog("The DERP map has been written to %s", cliui.Code(derpmapOut))
+				useStr += derpmapOut
+			} else {
+				fmt.Println(string(dmJSON))
+				hlog("The DERP map has been printed to stdout, save it to a file")
+				useStr += "<file>"
+			}
+			if secret != "" {
+				useStr += " --derp-secret <secret>"
+			}
+			hlog("Use it with %s", cliui.Code(useStr))
+			hlog("Relay listening on %s", cliui.Code(addr))
+
+			err = srv.ServeTLS(ln, "", "")
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		},
+		Options: []serpent.Option{
+			{
+				Flag:        "hostname",
+				Env:         "WUSH_RELAY_HOSTNAME",
+				Description: "Public hostname of the relay. Clients connect to it, and it must match the TLS certificate.",
+				Default:     "",
+				Value:       serpent.StringOf(&hostname),
+			},
+			{
+				Flag:        "addr",
+				Description: "Address to serve DERP over HTTPS on. Let's Encrypt certificates need port 443.",
+				Default:     ":443",
+				Value:       serpent.StringOf(&addr),
+			},
+			{
+				Flag:        "stun-port",
+				Description: "UDP port to serve STUN on. Set to 0 to disable STUN.",
+				Default:     "3478",
+				Value:       serpent.Int64Of(&stunPort),
+			},
+			{
+				Flag:        "region-id",
+				Description: "DERP region ID of the relay in the DERP map. Relays used together need different IDs.",
+				Default:     "900",
+				Value:       serpent.Int64Of(&regionID),
+			},
+			{
+				Flag:        "cert-file",
+				Description: "TLS certificate for --hostname. By default, one is requested from Let's Encrypt.",
+				Default:     "",
+				Value:       serpent.StringOf(&certFile),
+			},
+			{
+				Flag:        "key-file",
+				Description: "Private key of --cert-file.",
+				Default:     "",
+				Value:       serpent.StringOf(&keyFile),
+			},
+			{
+				Flag:        "cert-dir",
+				Env:         "WUSH_RELAY_CERT_DIR",
+				Description: "Directory to cache Let's Encrypt certificates in. Defaults to wush/certs in the user cache dir.",
+				Default:     "",
+				Value:       serpent.StringOf(&certDir),
+			},
+			{
+				Flag:        "secret",
+				Env:         "WUSH_RELAY_SECRET",
+				Description: "Only let in clients that know this shared secret. Pass it to wush serve with --derp-secret, which includes it in auth keys.",
+				Default:     "",
+				Value:       serpent.StringOf(&secret),
+			},
+			{
+				Flag:        "derp-map-file",
+				Description: "Write the relay's DERP map to this file instead of stdout.",
+				Default:     "",
+				Value:       serpent.StringOf(&derpmapOut),
+			},
+			{
+				Flag:          "verbose",
+				FlagShorthand: "v",
+				Description:   "Enable verbose logging.",
+				Default:       "false",
+				Value:         serpent.BoolOf(&verbose),
+			},
+		},
+	}
+}
+
+// relayTLSConfig serves the certificate in certFile, or one from Let's Encrypt
+// for hostname. The DERP server's meta certificate is appended to it, which
+// lets clients skip a round trip when connecting.
+func relayTLSConfig(s *derp.Server, hostname, certFile, keyFile, certDir string) (*tls.Config, error) {
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+		cert.Certificate = append(cert.Certificate, s.MetaCert())
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	}
+
+	if certDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("get user cache dir: %w", err)
+		}
+		certDir = filepath.Join(cacheDir, "wush", "certs")
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hostname),
+		Cache:      autocert.DirCache(certDir),
+	}
+	tlsConfig := m.TLSConfig()
+	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.GetCertificate = func(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := m.GetCertificate(hi)
+		if err != nil {
+			return nil, err
+		}
+		withMeta := *cert
+		withMeta.Certificate = append(slices.Clip(cert.Certificate), s.MetaCert())
+		return &withMeta, nil
+	}
+	return tlsConfig, nil
+}
+
+// maxAdmittedKeys is how many DERP keys a relay keeps admitted. Every client
+// that knows the secret can admit keys, so once there are more, the least
+// recently used ones are forgotten.
+const maxAdmittedKeys = 1 << 16
+
+// relayAdmission lets DERP keys into a relay once a client that knows the
+// shared secret has admitted them. Keys stay admitted until the relay exits, or
+// until maxAdmittedKeys more recently used ones have been admitted.
+type relayAdmission struct {
+	secret string
+
+	mu   sync.Mutex
+	keys lru.Cache[key.NodePublic, struct{}]
+}
+
+// admit handles overlay.RelayAdmitRequests.
+func (a *relayAdmission) admit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+a.secret)) != 1 {
+		http.Error(w, "invalid secret", http.StatusForbidden)
+		return
+	}
+
+	var req overlay.RelayAdmitRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	for _, k := range req.Keys {
+		a.keys.Set(k, struct{}{})
+	}
+	a.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verify answers the DERP server's requests to let a client in.
+func (a *relayAdmission) verify(w http.ResponseWriter, r *http.Request) {
+	var req tailcfg.DERPAdmitClientRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	// Checking a key counts as using it.
+	ok := a.keys.Contains(req.NodePublic)
+	a.mu.Unlock()
+	_ = json.NewEncoder(w).Encode(tailcfg.DERPAdmitClientResponse{Allow: ok})
+}
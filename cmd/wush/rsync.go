@@ -11,6 +11,7 @@ import (
 
 	"github.com/coder/serpent"
 	"github.com/coder/wush/cliui"
+	"github.com/coder/wush/overlay"
 	"github.com/coder/wush/tsserver"
 )
 
@@ -43,22 +44,30 @@ func rsyncCmd() *serpent.Command {
 			),
 		Middleware: serpent.Chain(
 			initLogger(&verbose, ptr.To(false), logger, &logf),
-			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth),
+			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth, overlay.ScopeSSH),
 		),
 		Handler: func(inv *serpent.Invocation) error {
 			ctx := inv.Context()
 
-			dm, err := tsserver.DERPMapTailscale(inv.Context())
-			if err != nil {
-				return err
+			dm := overlayOpts.clientAuth.DERPMap
+			if dm == nil && overlayOpts.clientAuth.ReceiverDERPRegionID != 0 {
+				var err error
+				dm, err = tsserver.DERPMapTailscale(inv.Context())
+				if err != nil {
+					return err
+				}
 			}
 			overlayOpts.clientAuth.PrintDebug(logf, dm)
 
+			authKey, err := overlayOpts.clientAuth.AuthKey()
+			if err != nil {
+				return err
+			}
 			progPath := os.Args[0]
 			args := []string{
 				"-c",
 				fmt.Sprintf(`rsync -e "%s ssh --auth-key %s --quiet --" %s`,
-					progPath, overlayOpts.clientAuth.AuthKey(), strings.Join(inv.Args, " "),
+					progPath, authKey, strings.Join(inv.Args, " "),
 				),
 			}
 			fmt.Println("Running rsync", strings.Join(inv.Args, " "))
@@ -2,24 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/afero"
-	xslices "golang.org/x/exp/slices"
 	"golang.org/x/xerrors"
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/store"
+	"tailscale.com/logtail"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 
@@ -35,11 +42,27 @@ import (
 
 func serveCmd() *serpent.Command {
 	var (
-		overlayType string
-		verbose     bool
-		enabled     = []string{}
-		disabled    = []string{}
-		derpmapFi   string
+		overlayTypes []string
+		verbose      bool
+		enabled      = []string{}
+		disabled     = []string{}
+		derpmapFi    string
+		derpSecret   string
+		keyExpiry    time.Duration
+		allowPorts   []string
+		pairCode     bool
+		once         bool
+		stateDir     string
+		rotateKey    bool
+		approve      bool
+		trustedFi    string
+		showQR       bool
+		qrFile       string
+		directAddr   string
+		stunServers  []string
+		stunIPv6     bool
+		routeStrs    []string
+		exitNode     bool
 
 		dm = new(tailcfg.DERPMap)
 	)
@@ -59,63 +82,277 @@ func serveCmd() *serpent.Command {
 			hlog := func(format string, args ...any) {
 				fmt.Fprintf(inv.Stderr, format+"\n", args...)
 			}
+			// Only the DERP overlay and pairing codes need a DERP map, so
+			// Tailscale isn't contacted otherwise.
+			if slices.Contains(overlayTypes, "derp") || pairCode {
+				err := requireDERPMap(ctx, derpmapFi, dm)
+				if err != nil {
+					return err
+				}
+			}
 			r := overlay.NewReceiveOverlay(logger, hlog, dm)
+			r.SelfHostedDERP = derpmapFi != ""
+			if derpSecret != "" {
+				if derpmapFi == "" {
+					return errors.New("--derp-secret requires --derp-config-file")
+				}
+				if pairCode {
+					return errors.New("--code can't be used with --derp-secret, as clients redeem the code before they know the secret")
+				}
+				r.DERPSecret = derpSecret
+			}
+			r.OnReconnect = logReconnect(hlog)
 
-			var err error
-			switch overlayType {
-			case "derp":
-				err = r.PickDERPHome(ctx)
+			statePath := ""
+			if stateDir != "" {
+				statePath = filepath.Join(stateDir, "wush.json")
+				if rotateKey {
+					hlog("Rotating auth keys, previously printed keys will no longer work")
+				} else {
+					err := r.LoadState(statePath)
+					if err != nil && !errors.Is(err, fs.ErrNotExist) {
+						return fmt.Errorf("load state: %w", err)
+					}
+				}
+			} else if rotateKey {
+				return errors.New("--rotate-key requires --state-dir")
+			}
+			if pairCode && qrFile != "" {
+				return errors.New("--qr-file can't be used with --code, as it contains the auth key")
+			}
+			saveState := func() {
+				if statePath == "" {
+					return
+				}
+				err := r.SaveState(statePath)
+				if err != nil {
+					hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to save state: "+err.Error()))
+				}
+			}
+
+			enabledScope, err := overlay.ScopeFromNames(enabled)
+			if err != nil {
+				return err
+			}
+			disabledScope, err := overlay.ScopeFromNames(disabled)
+			if err != nil {
+				return err
+			}
+			// Keys can only grant features that are enabled on the server.
+			features := enabledScope &^ disabledScope
+			policy := overlay.Policy{Scope: features}
+			if keyExpiry > 0 {
+				policy.Expiry = time.Now().Add(keyExpiry)
+			}
+			for _, portStr := range allowPorts {
+				for _, p := range strings.Split(portStr, ",") {
+					port, err := parsePort(p)
+					if err != nil {
+						return fmt.Errorf("parse allowed port: %w", err)
+					}
+					policy.Ports = append(policy.Ports, port)
+				}
+			}
+			slices.Sort(policy.Ports)
+			policy.Ports = slices.Compact(policy.Ports)
+			if len(policy.Ports) > overlay.MaxPorts {
+				return fmt.Errorf("--allow-ports can list at most %d ports, got %d", overlay.MaxPorts, len(policy.Ports))
+			}
+			routes, err := parseRoutes(routeStrs, exitNode)
+			if err != nil {
+				return err
+			}
+			// Routed connections are authorized like forwarded ports.
+			if len(routes) > 0 && !features.Has(overlay.ScopePortForward) {
+				return errors.New("--advertise-routes and --exit-node require port-forward to be enabled")
+			}
+			// Keys loaded from --state-dir keep the policy they were minted
+			// with, as previously printed keys carry it.
+			defaultKey, ok := r.Keys.Get("default")
+			if !ok {
+				defaultKey, err = r.Keys.Mint("default", policy)
 				if err != nil {
 					return err
 				}
-				go r.ListenOverlayDERP(ctx)
+			} else if flag := policyMismatch(defaultKey, policy, keyExpiry); flag != "" {
+				return fmt.Errorf("%s differs from the saved auth key's policy (%s); pass --rotate-key to mint a new key with it", flag, defaultKey.Policy.String())
+			}
+			r.Once = once
 
-			case "stun":
-				waitStun, err := r.ListenOverlaySTUN(ctx)
+			var console *serveConsole
+			if isatty.IsTerminal(os.Stdin.Fd()) {
+				console = newServeConsole(hlog)
+			}
+			if approve {
+				if trustedFi == "" {
+					trustedFi, err = defaultTrustedClientsPath(stateDir)
+					if err != nil {
+						return err
+					}
+				}
+				trusted, err := loadTrustedClients(trustedFi)
 				if err != nil {
-					return fmt.Errorf("get stun addr: %w", err)
+					return err
 				}
-				<-waitStun
+				r.Approve = approveConnection(trusted, console, hlog)
+			}
 
-			default:
-				return fmt.Errorf("unknown overlay type: %s", overlayType)
+			var sessions *sessionTracker
+			if once {
+				sessions = newSessionTracker()
+			}
+
+			if len(overlayTypes) == 0 {
+				return errors.New("at least one overlay type must be enabled")
+			}
+			if slices.Contains(overlayTypes, "direct") != (directAddr != "") {
+				return errors.New("--direct-addr must be set with, and only with, the direct overlay")
+			}
+			if slices.Contains(overlayTypes, "direct") && slices.Contains(overlayTypes, "stun") {
+				return errors.New("the direct and stun overlays can't be used together, as auth keys only hold one UDP address")
+			}
+			if directAddr != "" {
+				r.DirectAddr, err = netip.ParseAddrPort(directAddr)
+				if err != nil {
+					return fmt.Errorf("parse direct addr: %w", err)
+				}
 			}
+			r.STUNServers = stunServers
+			r.STUNIPv6 = stunIPv6
+			if !pairCode {
+				r.OnSTUNAddrChange = func(netip.AddrPort) {
+					authKey, err := r.ClientAuth(defaultKey).AuthKey()
+					if err != nil {
+						hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to encode updated auth key: "+err.Error()))
+						return
+					}
+					hlog("Connected clients have been told the new address. New clients need the updated auth key:")
+					fmt.Println("  >", cliui.Code(authKey))
+				}
+			}
+			for _, typ := range overlayTypes {
+				// STUN is optional if another overlay is also enabled, as it
+				// is commonly blocked.
+				optional := typ == "stun" && len(overlayTypes) > 1
+				ready, err := r.ListenOverlay(ctx, typ)
+				if err != nil && !optional {
+					return fmt.Errorf("listen %s overlay: %w", typ, err)
+				}
+				if err != nil {
+					hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to start "+typ+" overlay, it won't be in the auth key: "+err.Error()))
+				} else if optional {
+					select {
+					case <-ready:
+					case <-time.After(stunTimeout):
+						hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Timed out waiting for a STUN address, it won't be in the auth key"))
+					}
+				} else {
+					<-ready
+				}
+			}
+			saveState()
+
+			if pairCode {
+				pl, err := r.ListenPairing(ctx)
+				if err != nil {
+					return fmt.Errorf("create pairing code: %w", err)
+				}
+				code := pl.Code()
+				go func() {
+					err := pl.Serve(ctx, defaultKey)
+					if err != nil && ctx.Err() == nil {
+						hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Pairing code is no longer valid: "+err.Error()))
+					}
+				}()
 
-			// Ensure we always print the auth key on stdout
-			if isatty.IsTerminal(os.Stdout.Fd()) {
-				hlog("Your auth key is:")
-				fmt.Println("  >", cliui.Code(r.ClientAuth().AuthKey()))
-				hlog("Use this key to authenticate other " + cliui.Code("wush") + " commands to this instance.")
-				hlog("Visit the following link to connect via the browser:")
-				fmt.Println("  >", cliui.Code("https://wush.dev#"+r.ClientAuth().AuthKey()))
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					hlog("Your pairing code is:")
+					fmt.Println("  >", cliui.Code(code.String()))
+					hlog("Use this code with " + cliui.Code("wush ssh --code") + " to connect to this instance. It can only be used once.")
+				} else {
+					fmt.Println(cliui.Code(code.String()))
+					hlog("The pairing code has been printed to stdout")
+				}
 			} else {
-				fmt.Println(cliui.Code(r.ClientAuth().AuthKey()))
-				hlog("The auth key has been printed to stdout")
+				authKey, err := r.ClientAuth(defaultKey).AuthKey()
+				if err != nil {
+					return fmt.Errorf("encode auth key: %w", err)
+				}
+				// Ensure we always print the auth key on stdout
+				if isatty.IsTerminal(os.Stdout.Fd()) {
+					hlog("Your auth key is:")
+					fmt.Println("  >", cliui.Code(authKey))
+					hlog("Use this key to authenticate other " + cliui.Code("wush") + " commands to this instance.")
+					hlog("Visit the following link to connect via the browser:")
+					fmt.Println("  >", cliui.Code(authKeyURL(authKey)))
+					if showQR {
+						qr, err := cliui.QRCode(authKeyURL(authKey))
+						if err != nil {
+							hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to render QR code: "+err.Error()))
+						} else {
+							fmt.Print(qr)
+						}
+					}
+				} else {
+					fmt.Println(cliui.Code(authKey))
+					hlog("The auth key has been printed to stdout")
+				}
+				if qrFile != "" {
+					err := writeQRFile(qrFile, authKeyURL(authKey))
+					if err != nil {
+						return err
+					}
+					hlog("A QR code of the browser link has been written to %s", cliui.Code(qrFile))
+				}
 			}
 
 			s, err := tsserver.NewServer(ctx, logger, r, dm)
 			if err != nil {
 				return err
 			}
+			s.SetNoiseKey(r.ControlPriv)
+			selfIPs, err := r.IPs(ctx)
+			if err != nil {
+				return err
+			}
+			s.SetPacketFilter(tsserver.FilterAllowTCPPorts(selfIPs, featurePorts(features, policy.Ports)...))
+			s.SetRoutes(routes)
+			if len(routes) > 0 {
+				s.SetRouteFilter(func(peers []*tailcfg.Node) []tailcfg.FilterRule {
+					return tsserver.FilterAllowRoutes(routes, portForwardPeers(r, peers), portRanges(policy.Ports)...)
+				})
+			}
 
 			go s.ListenAndServe(ctx)
 			netns.SetDialerOverride(s.Dialer())
-			ts, err := newTSNet("receive", verbose)
+			ts, err := newTSNet("receive", verbose, stateDir)
 			if err != nil {
 				return err
 			}
 
-			_, err = ts.Up(ctx)
+			err = upTSNet(ctx, ts, dm)
 			if err != nil {
 				return fmt.Errorf("bring wireguard up: %w", err)
 			}
+			// Routes are always set, so ones persisted in --state-dir by a
+			// previous run are withdrawn.
+			err = advertiseRoutes(ctx, ts, routes)
+			if err != nil {
+				return err
+			}
+			if exitNode {
+				hlog("Advertising this machine as an exit node")
+			}
+			if subnets := slices.DeleteFunc(slices.Clone(routes), tsaddr.IsExitRoute); len(subnets) > 0 {
+				hlog("Advertising routes to %s", cliui.Code(joinPrefixes(subnets)))
+			}
 			fs := afero.NewOsFs()
 
 			// hlog("WireGuard is ready")
 
 			closers := []io.Closer{}
 
-			if xslices.Contains(enabled, "ssh") && !xslices.Contains(disabled, "ssh") {
+			if features.Has(overlay.ScopeSSH) {
 				sshSrv, err := agentssh.NewServer(ctx,
 					cslog.Make(csloghuman.Sink(logSink)),
 					prometheus.NewRegistry(),
@@ -131,6 +368,7 @@ func serveCmd() *serpent.Command {
 				if err != nil {
 					return err
 				}
+				sshListener = authorizedListener{Listener: sshListener, r: r, scope: overlay.ScopeSSH, sessions: sessions}
 				closers = append(closers, sshListener)
 
 				// TODO: replace these logs with all of the options in the beginning.
@@ -145,7 +383,7 @@ func serveCmd() *serpent.Command {
 				hlog("SSH server " + pretty.Sprint(cliui.DefaultStyles.Disabled, "disabled"))
 			}
 
-			if xslices.Contains(enabled, "cp") && !xslices.Contains(disabled, "cp") {
+			if features.Has(overlay.ScopeCp) {
 				cpListener, err := ts.Listen("tcp", ":4444")
 				if err != nil {
 					return err
@@ -154,7 +392,7 @@ func serveCmd() *serpent.Command {
 
 				// hlog("File transfer server " + pretty.Sprint(cliui.DefaultStyles.Enabled, "enabled"))
 				go func() {
-					err := http.Serve(cpListener, http.HandlerFunc(cpHandler))
+					err := http.Serve(cpListener, authorizeHandler(r, overlay.ScopeCp, sessions, cpHandler))
 					if err != nil {
 						hlog("File transfer server exited: " + err.Error())
 					}
@@ -163,10 +401,27 @@ func serveCmd() *serpent.Command {
 				hlog("File transfer server " + pretty.Sprint(cliui.DefaultStyles.Disabled, "disabled"))
 			}
 
-			if xslices.Contains(enabled, "port-forward") && !xslices.Contains(disabled, "port-forward") {
+			if features.Has(overlay.ScopePortForward) {
 				ts.RegisterFallbackTCPHandler(func(src, dst netip.AddrPort) (handler func(net.Conn), intercept bool) {
+					if err := r.Authorize(src.Addr(), overlay.ScopePortForward, dst.Port()); err != nil {
+						hlog(pretty.Sprint(cliui.DefaultStyles.Warn, fmt.Sprintf("Rejected forwarded connection from %s: %s", src.Addr(), err)))
+						// Not intercepting would let netstack forward it.
+						return nil, true
+					}
+					// Connections to advertised routes are left to netstack,
+					// which dials them from this machine. Other addresses
+					// aren't ours to reach.
+					if !slices.Contains(selfIPs, dst.Addr().Unmap()) {
+						if tsaddr.PrefixesContainsIP(routes, dst.Addr().Unmap()) {
+							return nil, false
+						}
+						return nil, true
+					}
 					return func(src net.Conn) {
-						dst, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", dst.Port()))
+						sessions.start()
+						defer sessions.end()
+
+						dst, err := dialLoopback(dst.Port())
 						if err != nil {
 							hlog(pretty.Sprint(cliui.DefaultStyles.Warn, "Failed to dial forwarded connection:", err.Error()))
 							src.Close()
@@ -184,8 +439,27 @@ func serveCmd() *serpent.Command {
 			ctx, ctxCancel := inv.SignalNotifyContext(ctx, os.Interrupt)
 			defer ctxCancel()
 
+			if once {
+				hlog("Only the first peer will be accepted. wush will exit once its sessions end.")
+			}
+			if approve {
+				hlog("New clients must be approved before they can connect.")
+			}
+			if console != nil {
+				hlog("Type %s to mint or revoke auth keys.", cliui.Code("help"))
+				go console.run(inv.Stdin, func(args []string) {
+					serveKeyCommand(args, r, policy, keyExpiry, hlog, saveState)
+				})
+			}
+
 			closers = append(closers, ts)
-			<-ctx.Done()
+			select {
+			case <-ctx.Done():
+			case <-sessions.done():
+				hlog("%s Peer sessions ended, exiting", cliui.Timestamp(time.Now()))
+			case <-r.OnceLeft():
+				hlog("%s Peer left, exiting", cliui.Timestamp(time.Now()))
+			}
 			for _, closer := range closers {
 				closer.Close()
 			}
@@ -193,9 +467,29 @@ func serveCmd() *serpent.Command {
 		},
 		Options: []serpent.Option{
 			{
-				Flag:    "overlay-type",
-				Default: "derp",
-				Value:   serpent.EnumOf(&overlayType, "derp", "stun"),
+				Flag:        "overlay-type",
+				Description: "Overlays to exchange nodes with clients over. Clients try all of them at once and use whichever answers first. With lan, clients on the same network find this instance without needing the internet. With direct, clients connect to --direct-addr.",
+				Default:     "derp,stun",
+				Value:       serpent.EnumArrayOf(&overlayTypes, overlay.TransportNames()...),
+			},
+			{
+				Flag:        "direct-addr",
+				Description: "IPv4 address and UDP port clients can reach this instance at, for the direct overlay. It is put in the auth key as is, so no STUN server is needed. The port is listened on on all interfaces.",
+				Default:     "",
+				Value:       serpent.StringOf(&directAddr),
+			},
+			{
+				Flag:        "stun-server",
+				Env:         "WUSH_STUN_SERVERS",
+				Description: "STUN servers the stun overlay finds its address with, as host:port. All of them are asked, so the others are a fallback if one is down, and comparing their answers detects NAT that makes the stun overlay unusable.",
+				Default:     strings.Join(overlay.DefaultSTUNServers, ","),
+				Value:       serpent.StringArrayOf(&stunServers),
+			},
+			{
+				Flag:        "stun-ipv6",
+				Description: "Find the stun overlay's address over IPv6 instead of IPv4. Clients must have IPv6 connectivity to use it.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&stunIPv6),
 			},
 			{
 				Flag:          "verbose",
@@ -218,15 +512,101 @@ func serveCmd() *serpent.Command {
 			},
 			{
 				Flag:        "derp-config-file",
-				Description: "File which specifies the DERP config to use. In the structure of https://pkg.go.dev/tailscale.com@v1.74.1/tailcfg#DERPMap.",
+				Description: "File which specifies the DERP config to use. In the structure of https://pkg.go.dev/tailscale.com@v1.74.1/tailcfg#DERPMap. The hostname and ports of the first node in each region are included in the auth key, so clients don't need the file.",
 				Default:     "",
 				Value:       serpent.StringOf(&derpmapFi),
 			},
+			{
+				Flag:        "derp-secret",
+				Env:         "WUSH_DERP_SECRET",
+				Description: "Shared secret required by the relays in --derp-config-file, as set with wush relay --secret. It is included in the auth key.",
+				Default:     "",
+				Value:       serpent.StringOf(&derpSecret),
+			},
+			{
+				Flag:        "key-expiry",
+				Description: "Reject new connections after the auth key has been valid for this long. By default the auth key never expires. Changing it for a key saved in --state-dir requires --rotate-key.",
+				Default:     "0s",
+				Value:       serpent.DurationOf(&keyExpiry),
+			},
+			{
+				Flag:        "allow-ports",
+				Description: "Restrict port-forwarding to the given ports. By default all ports may be forwarded.",
+				Value:       serpent.StringArrayOf(&allowPorts),
+			},
+			{
+				Flag:        "state-dir",
+				Env:         "WUSH_STATE_DIR",
+				Description: "Directory to persist auth keys, the WireGuard node key and the DERP home in, so the auth key stays the same across restarts.",
+				Default:     "",
+				Value:       serpent.StringOf(&stateDir),
+			},
+			{
+				Flag:        "rotate-key",
+				Description: "Generate new auth keys, replacing the ones saved in --state-dir.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&rotateKey),
+			},
+			{
+				Flag:        "once",
+				Description: "Accept only the first peer that connects, and exit once its sessions end.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&once),
+			},
+			{
+				Flag:        "approve",
+				Description: "Prompt before accepting each new client. Clients can be trusted to skip the prompt on future connections.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&approve),
+			},
+			{
+				Flag:        "trusted-clients",
+				Env:         "WUSH_TRUSTED_CLIENTS",
+				Description: "File of client identities --approve accepts without prompting. Defaults to trusted_clients in --state-dir, or the user config dir.",
+				Default:     "",
+				Value:       serpent.StringOf(&trustedFi),
+			},
+			{
+				Flag:        "advertise-routes",
+				Description: "Subnets on this machine's network, e.g. 10.0.0.0/24, that clients can open TCP connections to through it. Requires port-forward, and only clients whose auth key allows port-forward can use them, on the ports in --allow-ports.",
+				Default:     "",
+				Value:       serpent.StringArrayOf(&routeStrs),
+			},
+			{
+				Flag:        "exit-node",
+				Description: "Let clients open TCP connections to the internet through this machine. Requires port-forward, and only clients whose auth key allows port-forward can use it, on the ports in --allow-ports.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&exitNode),
+			},
+			{
+				Flag:        "code",
+				Description: "Print a short, single-use pairing code instead of the auth key. Clients redeem it with --code.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&pairCode),
+			},
+			{
+				Flag:        "qr",
+				Description: "Also show the browser link as a QR code when stdout is a terminal, for scanning with a phone.",
+				Default:     "false",
+				Value:       serpent.BoolOf(&showQR),
+			},
+			{
+				Flag:        "qr-file",
+				Description: "Write a QR code of the browser link to this file as a PNG.",
+				Default:     "",
+				Value:       serpent.StringOf(&qrFile),
+			},
 		},
 	}
 }
 
-func newTSNet(direction string, verbose bool) (*tsnet.Server, error) {
+// stunTimeout is how long serve waits for a STUN address before giving up on
+// the STUN overlay, when DERP is also enabled.
+const stunTimeout = 5 * time.Second
+
+// newTSNet creates a tsnet server. If stateDir is set, the WireGuard node key
+// and other tailscale state is persisted there, otherwise it is kept in memory.
+func newTSNet(direction string, verbose bool, stateDir string) (*tsnet.Server, error) {
 	var err error
 	tmp := os.TempDir()
 	srv := new(tsnet.Server)
@@ -236,6 +616,9 @@ func newTSNet(direction string, verbose bool) (*tsnet.Server, error) {
 	srv.AuthKey = direction
 	srv.ControlURL = "http://127.0.0.1:8080"
 	srv.Logf = func(format string, args ...any) {}
+	// Peers aren't on a Tailscale account, so there's no one to upload logs
+	// for.
+	logtail.Disable()
 	srv.UserLogf = func(format string, args ...any) {}
 	if verbose {
 		logf := func(format string, args ...any) {
@@ -245,7 +628,17 @@ func newTSNet(direction string, verbose bool) (*tsnet.Server, error) {
 		srv.UserLogf = logf
 	}
 
-	srv.Store, err = store.New(func(format string, args ...any) {}, "mem:wush")
+	storePath := "mem:wush"
+	if stateDir != "" {
+		srv.Dir = filepath.Join(stateDir, "tailscale")
+		err = os.MkdirAll(srv.Dir, 0o700)
+		if err != nil {
+			return nil, xerrors.Errorf("create tailscale state dir: %w", err)
+		}
+		storePath = filepath.Join(srv.Dir, "tailscaled.state")
+	}
+
+	srv.Store, err = store.New(func(format string, args ...any) {}, storePath)
 	if err != nil {
 		return nil, xerrors.Errorf("create state store: %w", err)
 	}
@@ -253,6 +646,148 @@ func newTSNet(direction string, verbose bool) (*tsnet.Server, error) {
 	return srv, nil
 }
 
+// dialLoopback dials port on IPv4 loopback, falling back to IPv6 for
+// services that only listen there.
+func dialLoopback(port uint16) (net.Conn, error) {
+	conn, err := net.Dial("tcp", netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port).String())
+	if err == nil {
+		return conn, nil
+	}
+	conn, err6 := net.Dial("tcp", netip.AddrPortFrom(netip.IPv6Loopback(), port).String())
+	if err6 != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// featurePorts returns the ports that clients need to reach for features,
+// so that the ports of disabled features are closed. Port-forwarding is
+// limited to ports, if there are any.
+func featurePorts(features overlay.Scope, ports []uint16) []tailcfg.PortRange {
+	prs := []tailcfg.PortRange{}
+	if features.Has(overlay.ScopeSSH) {
+		prs = append(prs, tailcfg.PortRange{First: 3, Last: 3})
+	}
+	if features.Has(overlay.ScopeCp) {
+		prs = append(prs, tailcfg.PortRange{First: 4444, Last: 4444})
+	}
+	if features.Has(overlay.ScopePortForward) {
+		if len(ports) == 0 {
+			return []tailcfg.PortRange{tailcfg.PortRangeAny}
+		}
+		prs = append(prs, portRanges(ports)...)
+	}
+	return prs
+}
+
+// policyMismatch returns the flag that asks for a different policy than pk
+// was minted with, if any. Expiry durations can only be compared for keys that
+// recorded when they were issued.
+func policyMismatch(pk *overlay.PeerKey, want overlay.Policy, keyExpiry time.Duration) string {
+	if pk.Scope != want.Scope {
+		return "--enable/--disable"
+	}
+	have := slices.Clone(pk.Ports)
+	slices.Sort(have)
+	if !slices.Equal(slices.Compact(have), want.Ports) {
+		return "--allow-ports"
+	}
+	if pk.Expiry.IsZero() != (keyExpiry == 0) {
+		return "--key-expiry"
+	}
+	if !pk.Expiry.IsZero() && !pk.Issued.IsZero() &&
+		pk.Expiry.Sub(pk.Issued).Round(time.Second) != keyExpiry.Round(time.Second) {
+		return "--key-expiry"
+	}
+	return ""
+}
+
+// portRanges returns a port range for each of ports.
+func portRanges(ports []uint16) []tailcfg.PortRange {
+	prs := []tailcfg.PortRange{}
+	for _, port := range ports {
+		prs = append(prs, tailcfg.PortRange{First: port, Last: port})
+	}
+	return prs
+}
+
+// portForwardPeers returns the tailnet addresses of the peers whose auth key
+// lets them forward ports, and so use routes.
+func portForwardPeers(r *overlay.Receive, peers []*tailcfg.Node) []netip.Addr {
+	addrs := []netip.Addr{}
+	for _, peer := range peers {
+		for _, addr := range peer.Addresses {
+			if r.Authorize(addr.Addr(), overlay.ScopePortForward, 0) == nil {
+				addrs = append(addrs, addr.Addr())
+			}
+		}
+	}
+	return addrs
+}
+
+// parseRoutes parses the --advertise-routes flag, adding the exit routes if
+// exitNode is set.
+func parseRoutes(routeStrs []string, exitNode bool) ([]netip.Prefix, error) {
+	routes := []netip.Prefix{}
+	for _, routeStr := range routeStrs {
+		for _, r := range strings.Split(routeStr, ",") {
+			route, err := netip.ParsePrefix(strings.TrimSpace(r))
+			if err != nil {
+				return nil, fmt.Errorf("parse advertised route: %w", err)
+			}
+			if route != route.Masked() {
+				return nil, fmt.Errorf("advertised route %s has non-address bits set, did you mean %s?", route, route.Masked())
+			}
+			if tsaddr.IsExitRoute(route) {
+				return nil, fmt.Errorf("advertised route %s is an exit route, use --exit-node instead", route)
+			}
+			routes = append(routes, route)
+		}
+	}
+	if exitNode {
+		routes = append(routes, tsaddr.ExitRoutes()...)
+	}
+	tsaddr.SortPrefixes(routes)
+	return slices.Compact(routes), nil
+}
+
+// advertiseRoutes makes ts advertise routes in its Hostinfo, which tsserver
+// then routes to it if they were approved.
+func advertiseRoutes(ctx context.Context, ts *tsnet.Server, routes []netip.Prefix) error {
+	lc, err := ts.LocalClient()
+	if err != nil {
+		return err
+	}
+	_, err = lc.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:              ipn.Prefs{AdvertiseRoutes: routes},
+		AdvertiseRoutesSet: true,
+	})
+	if err != nil {
+		return fmt.Errorf("advertise routes: %w", err)
+	}
+	return nil
+}
+
+// joinPrefixes formats prefixes as a comma-separated list.
+func joinPrefixes(prefixes []netip.Prefix) string {
+	strs := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		strs = append(strs, p.String())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// upTSNet brings ts up. Without DERP, tsnet only reports that it is running
+// once a peer has completed a handshake, which needs us to be up first, so we
+// only wait for it to start.
+func upTSNet(ctx context.Context, ts *tsnet.Server, dm *tailcfg.DERPMap) error {
+	if len(dm.Regions) == 0 {
+		return ts.Start()
+	}
+	_, err := ts.Up(ctx)
+	return err
+}
+
 func bicopy(ctx context.Context, c1, c2 io.ReadWriteCloser) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -290,6 +825,205 @@ func bicopy(ctx context.Context, c1, c2 io.ReadWriteCloser) {
 	}
 }
 
+// serveKeyCommand runs a command typed into a running wush serve that manages
+// the auth keys it accepts. Peers using other keys are unaffected. Minted keys
+// start from the scope and ports of policy and last at most keyExpiry, if set,
+// which the command can only narrow.
+func serveKeyCommand(args []string, r *overlay.Receive, policy overlay.Policy, keyExpiry time.Duration, hlog func(format string, args ...any), onChange func()) {
+	switch args[0] {
+	case "keys":
+		for _, pk := range r.Keys.Keys() {
+			hlog("  %s: %s", cliui.Keyword(pk.Label), pk.Policy.String())
+		}
+
+	case "mint":
+		if len(args) < 2 || len(args) > 4 {
+			hlog("Usage: mint <label> [ssh,cp,port-forward] [expiry]")
+			return
+		}
+
+		policy := overlay.Policy{Scope: policy.Scope, Ports: policy.Ports}
+		if len(args) > 2 {
+			scope, err := overlay.ScopeFromNames(strings.Split(args[2], ","))
+			if err != nil {
+				hlog("Invalid scope: %s", err)
+				return
+			}
+			policy.Scope &= scope
+		}
+		expiry := keyExpiry
+		if len(args) > 3 {
+			d, err := time.ParseDuration(args[3])
+			if err != nil {
+				hlog("Invalid expiry: %s", err)
+				return
+			}
+			if keyExpiry == 0 || d < keyExpiry {
+				expiry = d
+			}
+		}
+		if expiry > 0 {
+			policy.Expiry = time.Now().Add(expiry)
+		}
+
+		pk, err := r.Keys.Mint(args[1], policy)
+		if err != nil {
+			hlog("Failed to mint key: %s", err)
+			return
+		}
+		onChange()
+		authKey, err := r.ClientAuth(pk).AuthKey()
+		if err != nil {
+			hlog("Failed to encode key: %s", err)
+			return
+		}
+		hlog("Minted key %s (%s):", cliui.Keyword(pk.Label), pk.Policy.String())
+		fmt.Println("  >", cliui.Code(authKey))
+
+	case "revoke":
+		if len(args) != 2 {
+			hlog("Usage: revoke <label>")
+			return
+		}
+		if !r.Revoke(args[1]) {
+			hlog("No key named %s", cliui.Keyword(args[1]))
+			return
+		}
+		onChange()
+		hlog("Revoked key %s", cliui.Keyword(args[1]))
+
+	default:
+		hlog("Commands:")
+		hlog("  %s  list auth keys", cliui.Code("keys"))
+		hlog("  %s  mint a new auth key, optionally limited to fewer features or a shorter expiry", cliui.Code("mint <label> [ssh,cp,port-forward] [expiry]"))
+		hlog("  %s  revoke an auth key and disconnect its peers", cliui.Code("revoke <label>"))
+	}
+}
+
+// authorizedListener closes accepted connections that are not allowed by the
+// auth key, such as after it has expired.
+type authorizedListener struct {
+	net.Listener
+	r        *overlay.Receive
+	scope    overlay.Scope
+	sessions *sessionTracker
+}
+
+func (l authorizedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := l.r.Authorize(remoteAddr(conn.RemoteAddr().String()), l.scope, 0); err != nil {
+			_ = conn.Close()
+			continue
+		}
+
+		if l.sessions != nil {
+			l.sessions.start()
+			conn = &trackedConn{Conn: conn, sessions: l.sessions}
+		}
+		return conn, nil
+	}
+}
+
+func authorizeHandler(r *overlay.Receive, scope overlay.Scope, sessions *sessionTracker, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := r.Authorize(remoteAddr(req.RemoteAddr), scope, 0); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		sessions.start()
+		defer sessions.end()
+		next(w, req)
+	})
+}
+
+// remoteAddr parses the address of a peer connecting over the tailnet.
+func remoteAddr(addr string) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr()
+}
+
+// sessionGracePeriod is how long serve --once waits for a new session after
+// the last one ends before exiting. This allows for clients that open several
+// connections in a row, such as port-forwarded browsers.
+const sessionGracePeriod = 10 * time.Second
+
+// sessionTracker counts the active sessions of the peer accepted by
+// serve --once. A nil *sessionTracker is valid and tracks nothing.
+type sessionTracker struct {
+	mu      sync.Mutex
+	active  int
+	timer   *time.Timer
+	doneCh  chan struct{}
+	endOnce sync.Once
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{doneCh: make(chan struct{})}
+}
+
+func (t *sessionTracker) start() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active++
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *sessionTracker) end() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.active--
+	if t.active > 0 {
+		return
+	}
+	t.timer = time.AfterFunc(sessionGracePeriod, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.active == 0 {
+			t.endOnce.Do(func() { close(t.doneCh) })
+		}
+	})
+}
+
+// done is closed once all sessions have ended. It is never closed if no
+// session was ever started.
+func (t *sessionTracker) done() <-chan struct{} {
+	if t == nil {
+		return nil
+	}
+	return t.doneCh
+}
+
+// trackedConn ends its session when closed.
+type trackedConn struct {
+	net.Conn
+	sessions  *sessionTracker
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.sessions.end)
+	return c.Conn.Close()
+}
+
 func cpHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.WriteHeader(http.StatusOK)
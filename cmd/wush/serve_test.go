@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		routeStrs []string
+		exitNode  bool
+		want      []string
+		wantErr   bool
+	}{
+		{name: "None", want: []string{}},
+		{
+			name:      "Sorted",
+			routeStrs: []string{"10.0.1.0/24, 10.0.0.0/24", "fd00::/64"},
+			want:      []string{"10.0.0.0/24", "10.0.1.0/24", "fd00::/64"},
+		},
+		{
+			name:      "Duplicates",
+			routeStrs: []string{"10.0.0.0/24", "10.0.0.0/24"},
+			want:      []string{"10.0.0.0/24"},
+		},
+		{
+			name:      "ExitNode",
+			routeStrs: []string{"10.0.0.0/24"},
+			exitNode:  true,
+			want:      []string{"0.0.0.0/0", "10.0.0.0/24", "::/0"},
+		},
+		{name: "Invalid", routeStrs: []string{"10.0.0.0"}, wantErr: true},
+		{name: "HostBits", routeStrs: []string{"10.0.0.1/24"}, wantErr: true},
+		{name: "ExitRoute", routeStrs: []string{"0.0.0.0/0"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			routes, err := parseRoutes(tc.routeStrs, tc.exitNode)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got routes %v", routes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := []netip.Prefix{}
+			for _, s := range tc.want {
+				want = append(want, netip.MustParsePrefix(s))
+			}
+			if !slices.Equal(routes, want) {
+				t.Fatalf("got routes %v, want %v", routes, want)
+			}
+		})
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"strings"
 	"time"
 
 	"tailscale.com/client/tailscale"
@@ -38,9 +38,10 @@ func sshCmd() *serpent.Command {
 		Long:    "Use " + cliui.Code("wush serve") + " on the computer you would like to connect to.",
 		Middleware: serpent.Chain(
 			initLogger(&verbose, &quiet, logger, &logf),
-			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth),
 			derpMap(&derpmapFi, dm),
-			sendOverlayMW(overlayOpts, &send, logger, dm, &logf),
+			initCode(&overlayOpts.code, &overlayOpts.authKey, &derpmapFi, dm, &logf),
+			initAuth(&overlayOpts.authKey, &overlayOpts.clientAuth, overlay.ScopeSSH),
+			sendOverlayMW(overlayOpts, &send, logger, &derpmapFi, dm, &logf),
 		),
 		Handler: func(inv *serpent.Invocation) error {
 			ctx := inv.Context()
@@ -49,24 +50,24 @@ func sshCmd() *serpent.Command {
 			if err != nil {
 				return err
 			}
+			// Nothing connects to us, so the receiver can't reach our
+			// node.
+			s.SetPacketFilter(tsserver.FilterAllowTCPPorts(nil))
 
-			if send.Auth.ReceiverDERPRegionID != 0 {
-				go send.ListenOverlayDERP(ctx)
-			} else if send.Auth.ReceiverStunAddr.IsValid() {
-				go send.ListenOverlaySTUN(ctx)
-			} else {
-				return errors.New("auth key provided neither DERP nor STUN")
+			ctx, err = listenSendOverlay(ctx, send)
+			if err != nil {
+				return err
 			}
 
 			go s.ListenAndServe(ctx)
 			netns.SetDialerOverride(s.Dialer())
-			ts, err := newTSNet("send", verbose)
+			ts, err := newTSNet("send", verbose, "")
 			if err != nil {
 				return err
 			}
 
 			logf("Bringing WireGuard up..")
-			ts.Up(ctx)
+			upTSNet(ctx, ts, dm)
 			logf("WireGuard is ready!")
 
 			lc, err := ts.LocalClient()
@@ -74,13 +75,13 @@ func sshCmd() *serpent.Command {
 				return err
 			}
 
-			ip, err := waitUntilHasPeerHasIP(ctx, logf, lc)
+			ip, err := waitUntilHasPeerHasIP(ctx, logf, lc, dm)
 			if err != nil {
 				return err
 			}
 
 			if overlayOpts.waitP2P {
-				err := waitUntilHasP2P(ctx, logf, lc)
+				err := waitUntilHasP2P(ctx, logf, lc, dm)
 				if err != nil {
 					return err
 				}
@@ -96,6 +97,13 @@ func sshCmd() *serpent.Command {
 				Default:     "",
 				Value:       serpent.StringOf(&overlayOpts.authKey),
 			},
+			{
+				Flag:        "code",
+				Env:         "WUSH_CODE",
+				Description: "A pairing code printed by " + cliui.Code("wush serve --code") + ". Can be used instead of --auth-key.",
+				Default:     "",
+				Value:       serpent.StringOf(&overlayOpts.code),
+			},
 			{
 				Flag:        "derp-config-file",
 				Description: "File which specifies the DERP config to use. In the structure of https://pkg.go.dev/tailscale.com@v1.74.1/tailcfg#DERPMap.",
@@ -130,11 +138,11 @@ func sshCmd() *serpent.Command {
 	}
 }
 
-func waitUntilHasPeerHasIP(ctx context.Context, logF func(str string, args ...any), lc *tailscale.LocalClient) (netip.Addr, error) {
+func waitUntilHasPeerHasIP(ctx context.Context, logF func(str string, args ...any), lc *tailscale.LocalClient, dm *tailcfg.DERPMap) (netip.Addr, error) {
 	for {
 		select {
 		case <-ctx.Done():
-			return netip.Addr{}, ctx.Err()
+			return netip.Addr{}, context.Cause(ctx)
 		case <-time.After(time.Second):
 		}
 
@@ -150,20 +158,24 @@ func waitUntilHasPeerHasIP(ctx context.Context, logF func(str string, args ...an
 			continue
 		}
 
-		logF("Received peer")
-
 		peer, ok := stat.Peer[peers[0]]
 		if !ok {
 			logF("have peers but not found in map (developer error)")
 			continue
 		}
 
-		if peer.Relay == "" {
+		logF("Received peer %s", cliui.Code(strings.TrimSuffix(peer.DNSName, ".")))
+
+		// Without DERP, peers are only reached directly, so there's no relay
+		// to wait for.
+		if peer.Relay == "" && len(dm.Regions) > 0 {
 			logF("peer no relay")
 			continue
 		}
 
-		logF("Peer active with relay %s", cliui.Code(peer.Relay))
+		if peer.Relay != "" {
+			logF("Peer active with relay %s", cliui.Code(peer.Relay))
+		}
 
 		if len(peer.TailscaleIPs) == 0 {
 			logF("peer has no ips (developer error)")
@@ -174,7 +186,7 @@ func waitUntilHasPeerHasIP(ctx context.Context, logF func(str string, args ...an
 	}
 }
 
-func waitUntilHasP2P(ctx context.Context, logF func(str string, args ...any), lc *tailscale.LocalClient) error {
+func waitUntilHasP2P(ctx context.Context, logF func(str string, args ...any), lc *tailscale.LocalClient, dm *tailcfg.DERPMap) error {
 	for {
 		select {
 		case <-ctx.Done():
@@ -195,7 +207,7 @@ func waitUntilHasP2P(ctx context.Context, logF func(str string, args ...any), lc
 			continue
 		}
 
-		if peer.Relay == "" {
+		if peer.Relay == "" && len(dm.Regions) > 0 {
 			logF("peer no relay")
 			continue
 		}
@@ -12,6 +12,7 @@ replace github.com/gliderlabs/ssh => github.com/coder/ssh v0.0.0-20231128192721-
 
 require (
 	cdr.dev/slog v1.6.2-0.20240126064726-20367d4aede6
+	filippo.io/edwards25519 v1.1.0
 	github.com/btcsuite/btcd/btcutil v1.1.6
 	github.com/charmbracelet/huh v0.6.0
 	github.com/coder/coder/v2 v2.16.0
@@ -23,7 +24,6 @@ require (
 	github.com/mattn/go-isatty v0.0.20
 	github.com/mitchellh/go-wordwrap v1.0.1
 	github.com/muesli/termenv v0.15.3-0.20240618155329-98d742f6907a
-	github.com/pion/stun/v3 v3.0.0
 	github.com/pion/webrtc/v4 v4.0.1
 	github.com/prometheus/client_golang v1.20.5
 	github.com/puzpuzpuz/xsync/v3 v3.4.0
@@ -37,11 +37,11 @@ require (
 	golang.org/x/sys v0.28.0
 	golang.org/x/term v0.27.0
 	golang.org/x/xerrors v0.0.0-20240903120638-7835f813f4da
+	rsc.io/qr v0.2.0
 	tailscale.com v1.76.1
 )
 
 require (
-	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/DataDog/appsec-internal-go v1.7.0 // indirect
 	github.com/DataDog/datadog-agent/pkg/obfuscate v0.48.0 // indirect
 	github.com/DataDog/datadog-agent/pkg/remoteconfig/state v0.48.1 // indirect
@@ -170,6 +170,7 @@ require (
 	github.com/pion/sctp v1.8.33 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v3 v3.0.4 // indirect
+	github.com/pion/stun/v3 v3.0.0 // indirect
 	github.com/pion/transport/v2 v2.2.10 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
 	github.com/pion/turn/v4 v4.0.0 // indirect
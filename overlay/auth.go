@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"net/netip"
+	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcutil/base58"
 	"github.com/coder/wush/cliui"
@@ -14,6 +17,71 @@ import (
 	"tailscale.com/types/key"
 )
 
+// Scope is a bitmask of the features an auth key grants access to.
+type Scope uint8
+
+const (
+	ScopeSSH Scope = 1 << iota
+	ScopeCp
+	ScopePortForward
+
+	ScopeAll = ScopeSSH | ScopeCp | ScopePortForward
+)
+
+var scopeNames = []struct {
+	scope Scope
+	name  string
+}{
+	{ScopeSSH, "ssh"},
+	{ScopeCp, "cp"},
+	{ScopePortForward, "port-forward"},
+}
+
+// ScopeFromNames converts feature names, as used by the --enable and --disable
+// flags of wush serve, into a Scope.
+func ScopeFromNames(names []string) (Scope, error) {
+	var s Scope
+	for _, name := range names {
+		found := false
+		for _, sn := range scopeNames {
+			if sn.name == name {
+				s |= sn.scope
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+	}
+	return s, nil
+}
+
+// Has reports whether all features in o are granted by s.
+func (s Scope) Has(o Scope) bool {
+	return s&o == o
+}
+
+func (s Scope) String() string {
+	names := []string{}
+	for _, sn := range scopeNames {
+		if s.Has(sn.scope) {
+			names = append(names, sn.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Flags of the peer type byte of auth keys. Keys from before LAN discovery
+// only ever set it to 0 or 1.
+const (
+	authFlagWeb = 1 << iota
+	authFlagLAN
+)
+
 type ClientAuth struct {
 	Web bool
 	// OverlayPrivateKey is the main auth mechanism used to secure the overlay.
@@ -29,6 +97,102 @@ type ClientAuth struct {
 	// ReceiverDERPRegionID is the region id that the receiver is reachable over
 	// DERP when the overlay is running in DERP mode.
 	ReceiverDERPRegionID uint16
+	// ReceiverLAN is whether the receiver can be discovered on the local
+	// network, by broadcasting for ReceiverPublicKey.
+	ReceiverLAN bool
+	// DERPMap is the self-hosted DERP map the receiver uses, if any. It is
+	// nil for Tailscale's public DERP map. Only the first DERP node of each
+	// region is kept.
+	DERPMap *tailcfg.DERPMap
+	// DERPSecret is the shared secret the relays of DERPMap require before
+	// letting keys connect, if any.
+	DERPSecret string
+
+	// Policy restricts what peers using this key are allowed to do.
+	Policy
+}
+
+// Policy is the expiry and set of features granted to peers holding an auth
+// key.
+type Policy struct {
+	// Expiry is the time after which the receiver will no longer accept
+	// connections using this key. A zero value never expires.
+	Expiry time.Time
+	// Scope is the set of features the key grants access to.
+	Scope Scope
+	// Ports restricts port-forwarding to the given ports. If empty, all ports
+	// may be forwarded when ScopePortForward is granted. At most MaxPorts
+	// ports can be encoded in an auth key.
+	Ports []uint16
+}
+
+// MaxPorts is the most ports a Policy can restrict port-forwarding to.
+const MaxPorts = 255
+
+// Expired reports whether the key is past its expiry.
+func (p Policy) Expired() bool {
+	return !p.Expiry.IsZero() && time.Now().After(p.Expiry)
+}
+
+// AllowsPort reports whether the key may forward to the given port.
+func (p Policy) AllowsPort(port uint16) bool {
+	if !p.Scope.Has(ScopePortForward) {
+		return false
+	}
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, allowed := range p.Ports {
+		if allowed == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize returns an error if the key does not grant access to scope. For
+// ScopePortForward, a non-zero port is checked against the allowed ports.
+func (p Policy) Authorize(scope Scope, port uint16) error {
+	if p.Expired() {
+		return fmt.Errorf("auth key expired at %s", p.Expiry.Format(time.RFC1123))
+	}
+	if !p.Scope.Has(scope) {
+		return fmt.Errorf("auth key does not grant %s", scope)
+	}
+	if scope == ScopePortForward && port != 0 && !p.AllowsPort(port) {
+		return fmt.Errorf("auth key does not allow forwarding port %d", port)
+	}
+	return nil
+}
+
+func (p Policy) String() string {
+	expiryStr := "never expires"
+	if !p.Expiry.IsZero() {
+		expiryStr = "expires " + p.Expiry.Format(time.RFC1123)
+	}
+	scopeStr := p.Scope.String()
+	if len(p.Ports) > 0 && p.Scope.Has(ScopePortForward) {
+		ports := make([]string, len(p.Ports))
+		for i, port := range p.Ports {
+			ports[i] = fmt.Sprint(port)
+		}
+		scopeStr += " (ports " + strings.Join(ports, ",") + ")"
+	}
+	return scopeStr + ", " + expiryStr
+}
+
+// Version returns the format version the key is encoded with.
+func (ca *ClientAuth) Version() int {
+	if ca.isV1() {
+		return 1
+	}
+	return 2
+}
+
+// isV1 reports whether the key can be encoded in the original key format,
+// which carries no expiry or scope and grants everything.
+func (ca *ClientAuth) isV1() bool {
+	return ca.Expiry.IsZero() && ca.Scope == ScopeAll && len(ca.Ports) == 0 && ca.DERPMap == nil
 }
 
 func (ca *ClientAuth) PrintDebug(logf func(str string, args ...any), dm *tailcfg.DERPMap) {
@@ -42,27 +206,53 @@ func (ca *ClientAuth) PrintDebug(logf func(str string, args ...any), dm *tailcfg
 	if ca.ReceiverDERPRegionID > 0 {
 		derpStr = dm.Regions[int(ca.ReceiverDERPRegionID)].RegionName
 	}
+	if ca.DERPMap != nil {
+		derpStr += " (self-hosted)"
+	}
+	if ca.DERPSecret != "" {
+		derpStr += " (secret)"
+	}
 	logf("\t> Server overlay DERP home:    %s", cliui.Code(derpStr))
+	lanStr := "Disabled"
+	if ca.ReceiverLAN {
+		lanStr = "Enabled"
+	}
+	logf("\t> Server overlay LAN:          %s", cliui.Code(lanStr))
 	logf("\t> Server overlay public key:   %s", cliui.Code(ca.ReceiverPublicKey.ShortString()))
 	logf("\t> Server overlay auth key:     %s", cliui.Code(ca.OverlayPrivateKey.Public().ShortString()))
+	logf("\t> Auth key policy:             %s", cliui.Code(ca.Policy.String()))
 }
 
-func (ca *ClientAuth) AuthKey() string {
-	buf := bytes.NewBuffer(nil)
+// AuthKey encodes the auth key. It fails if the policy or DERP map don't fit in
+// the key format.
+func (ca *ClientAuth) AuthKey() (string, error) {
+	// The secret is only encoded after the DERP map it belongs to.
+	if ca.DERPSecret != "" && ca.DERPMap == nil {
+		return "", errors.New("auth key can only carry a DERP secret along with a DERP map")
+	}
 
-	buf.WriteByte(1)
+	buf := bytes.NewBuffer(nil)
 
-	if ca.Web {
+	if ca.isV1() {
 		buf.WriteByte(1)
 	} else {
-		buf.WriteByte(0)
+		buf.WriteByte(2)
+	}
+
+	var flags byte
+	if ca.Web {
+		flags |= authFlagWeb
 	}
+	if ca.ReceiverLAN {
+		flags |= authFlagLAN
+	}
+	buf.WriteByte(flags)
 
 	buf.WriteByte(byte(ca.ReceiverStunAddr.Addr().BitLen() / 8))
 	if ca.ReceiverStunAddr.Addr().BitLen() > 0 {
 		stunBytes, err := ca.ReceiverStunAddr.MarshalBinary()
 		if err != nil {
-			panic(fmt.Sprint("failed to marshal stun addr:", err))
+			return "", fmt.Errorf("marshal stun addr: %w", err)
 		}
 		buf.Write(stunBytes)
 	}
@@ -77,7 +267,43 @@ func (ca *ClientAuth) AuthKey() string {
 	priv := ca.OverlayPrivateKey.Raw32()
 	buf.Write(priv[:])
 
-	return base58.Encode(buf.Bytes())
+	if !ca.isV1() {
+		var expiry int64
+		if !ca.Expiry.IsZero() {
+			expiry = ca.Expiry.Unix()
+		}
+		expiryBuf := [8]byte{}
+		binary.BigEndian.PutUint64(expiryBuf[:], uint64(expiry))
+		buf.Write(expiryBuf[:])
+
+		buf.WriteByte(byte(ca.Scope))
+
+		if len(ca.Ports) > MaxPorts {
+			return "", fmt.Errorf("auth key supports at most %d ports, got %d", MaxPorts, len(ca.Ports))
+		}
+		buf.WriteByte(byte(len(ca.Ports)))
+		for _, port := range ca.Ports {
+			portBuf := [2]byte{}
+			binary.BigEndian.PutUint16(portBuf[:], port)
+			buf.Write(portBuf[:])
+		}
+
+		if ca.DERPMap != nil {
+			err := writeDERPMap(buf, ca.DERPMap)
+			if err != nil {
+				return "", err
+			}
+			if ca.DERPSecret != "" {
+				if len(ca.DERPSecret) > 255 {
+					return "", errors.New("auth key supports DERP secrets of at most 255 bytes")
+				}
+				buf.WriteByte(byte(len(ca.DERPSecret)))
+				buf.WriteString(ca.DERPSecret)
+			}
+		}
+	}
+
+	return base58.Encode(buf.Bytes()), nil
 }
 
 func (ca *ClientAuth) Parse(authKey string) error {
@@ -92,18 +318,16 @@ func (ca *ClientAuth) Parse(authKey string) error {
 		return errors.New("read authkey version")
 	}
 
-	if ver != 1 {
-		return fmt.Errorf("unsupported authkey version %q", ver)
+	if ver != 1 && ver != 2 {
+		return fmt.Errorf("unsupported authkey version %d", ver)
 	}
 
-	typ, err := decr.ReadByte()
+	flags, err := decr.ReadByte()
 	if err != nil {
 		return errors.New("read authkey peer type")
 	}
-
-	if typ == 1 {
-		ca.Web = true
-	}
+	ca.Web = flags&authFlagWeb != 0
+	ca.ReceiverLAN = flags&authFlagLAN != 0
 
 	ipLenB, err := decr.ReadByte()
 	if err != nil {
@@ -144,5 +368,139 @@ func (ca *ClientAuth) Parse(authKey string) error {
 		return errors.New("read overlay privkey; invalid authkey")
 	}
 	ca.OverlayPrivateKey = key.NodePrivateFromRaw32(mem.B(privKeyBytes))
+
+	if ver == 1 {
+		ca.Scope = ScopeAll
+		return nil
+	}
+
+	expiryBytes := make([]byte, 8)
+	n, err = decr.Read(expiryBytes)
+	if n != len(expiryBytes) || err != nil {
+		return errors.New("read expiry; invalid authkey")
+	}
+	if expiry := int64(binary.BigEndian.Uint64(expiryBytes)); expiry != 0 {
+		ca.Expiry = time.Unix(expiry, 0)
+	}
+
+	scope, err := decr.ReadByte()
+	if err != nil {
+		return errors.New("read scope; invalid authkey")
+	}
+	ca.Scope = Scope(scope)
+
+	portsLen, err := decr.ReadByte()
+	if err != nil {
+		return errors.New("read ports len; invalid authkey")
+	}
+	ca.Ports = make([]uint16, 0, portsLen)
+	for range portsLen {
+		portBytes := make([]byte, 2)
+		n, err = decr.Read(portBytes)
+		if n != len(portBytes) || err != nil {
+			return errors.New("read port; invalid authkey")
+		}
+		ca.Ports = append(ca.Ports, binary.BigEndian.Uint16(portBytes))
+	}
+
+	if decr.Len() > 0 {
+		ca.DERPMap, err = readDERPMap(decr)
+		if err != nil {
+			return err
+		}
+	}
+	if decr.Len() > 0 {
+		secretLen, _ := decr.ReadByte()
+		secret := make([]byte, secretLen)
+		if n, err := decr.Read(secret); n != len(secret) || err != nil {
+			return errors.New("read DERP secret; invalid authkey")
+		}
+		ca.DERPSecret = string(secret)
+	}
 	return nil
 }
+
+// writeDERPMap encodes the first DERP node of each region as its region ID,
+// hostname, DERP port and STUN port. A STUN port of 0xffff disables STUN.
+func writeDERPMap(buf *bytes.Buffer, dm *tailcfg.DERPMap) error {
+	var nodes []*tailcfg.DERPNode
+	for _, id := range dm.RegionIDs() {
+		for _, node := range dm.Regions[id].Nodes {
+			if !node.STUNOnly {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	if len(nodes) > 255 {
+		return errors.New("auth key supports at most 255 DERP regions")
+	}
+
+	buf.WriteByte(byte(len(nodes)))
+	for _, node := range nodes {
+		if len(node.HostName) > 255 {
+			return fmt.Errorf("auth key supports DERP hostnames of at most 255 bytes, %q is longer", node.HostName)
+		}
+		if node.RegionID <= 0 || node.RegionID > math.MaxUint16 {
+			return fmt.Errorf("auth key supports DERP region IDs from 1 to %d, got %d", math.MaxUint16, node.RegionID)
+		}
+
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(node.RegionID))
+		buf.Write(b[:])
+		buf.WriteByte(byte(len(node.HostName)))
+		buf.WriteString(node.HostName)
+		binary.BigEndian.PutUint16(b[:], uint16(node.DERPPort))
+		buf.Write(b[:])
+		binary.BigEndian.PutUint16(b[:], uint16(node.STUNPort))
+		buf.Write(b[:])
+	}
+	return nil
+}
+
+func readDERPMap(decr *bytes.Reader) (*tailcfg.DERPMap, error) {
+	regionsLen, err := decr.ReadByte()
+	if err != nil {
+		return nil, errors.New("read DERP regions len; invalid authkey")
+	}
+
+	dm := &tailcfg.DERPMap{
+		Regions:            map[int]*tailcfg.DERPRegion{},
+		OmitDefaultRegions: true,
+	}
+	for range regionsLen {
+		var b [2]byte
+		if n, err := decr.Read(b[:]); n != len(b) || err != nil {
+			return nil, errors.New("read DERP region id; invalid authkey")
+		}
+		regionID := int(binary.BigEndian.Uint16(b[:]))
+
+		hostLen, err := decr.ReadByte()
+		if err != nil {
+			return nil, errors.New("read DERP hostname len; invalid authkey")
+		}
+		host := make([]byte, hostLen)
+		if n, err := decr.Read(host); n != len(host) || err != nil {
+			return nil, errors.New("read DERP hostname; invalid authkey")
+		}
+
+		var ports [4]byte
+		if n, err := decr.Read(ports[:]); n != len(ports) || err != nil {
+			return nil, errors.New("read DERP ports; invalid authkey")
+		}
+
+		dm.Regions[regionID] = &tailcfg.DERPRegion{
+			RegionID:   regionID,
+			RegionCode: string(host),
+			RegionName: string(host),
+			Nodes: []*tailcfg.DERPNode{{
+				Name:     fmt.Sprintf("%da", regionID),
+				RegionID: regionID,
+				HostName: string(host),
+				DERPPort: int(binary.BigEndian.Uint16(ports[:2])),
+				STUNPort: int(int16(binary.BigEndian.Uint16(ports[2:]))),
+			}},
+		}
+	}
+	return dm, nil
+}
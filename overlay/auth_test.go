@@ -0,0 +1,105 @@
+package overlay
+
+import (
+	"slices"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestAuthKeyPorts(t *testing.T) {
+	newAuth := func(ports []uint16) *ClientAuth {
+		return &ClientAuth{
+			ReceiverPublicKey: key.NewNode().Public(),
+			OverlayPrivateKey: key.NewNode(),
+			Policy:            Policy{Scope: ScopePortForward, Ports: ports},
+		}
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		ports := []uint16{22, 8080}
+		authKey, err := newAuth(ports).AuthKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed ClientAuth
+		err = parsed.Parse(authKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(parsed.Ports, ports) {
+			t.Fatalf("got ports %v, want %v", parsed.Ports, ports)
+		}
+	})
+
+	t.Run("TooMany", func(t *testing.T) {
+		ports := make([]uint16, MaxPorts+1)
+		for i := range ports {
+			ports[i] = uint16(i + 1)
+		}
+		_, err := newAuth(ports).AuthKey()
+		if err == nil {
+			t.Fatal("expected an error for too many ports")
+		}
+	})
+}
+
+func TestAuthKeyDERP(t *testing.T) {
+	derpMap := func(regionID int) *tailcfg.DERPMap {
+		return &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+			regionID: {
+				RegionID: regionID,
+				Nodes: []*tailcfg.DERPNode{{
+					RegionID: regionID,
+					HostName: "relay.example.com",
+					DERPPort: 443,
+					STUNPort: 3478,
+				}},
+			},
+		}}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		dm      *tailcfg.DERPMap
+		secret  string
+		wantErr bool
+	}{
+		{name: "MapAndSecret", dm: derpMap(900), secret: "hunter2"},
+		{name: "SecretWithoutMap", secret: "hunter2", wantErr: true},
+		{name: "RegionIDTooLarge", dm: derpMap(70000), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ca := &ClientAuth{
+				ReceiverPublicKey: key.NewNode().Public(),
+				OverlayPrivateKey: key.NewNode(),
+				DERPMap:           tc.dm,
+				DERPSecret:        tc.secret,
+				Policy:            Policy{Scope: ScopeAll},
+			}
+			authKey, err := ca.AuthKey()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var parsed ClientAuth
+			err = parsed.Parse(authKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.DERPSecret != tc.secret {
+				t.Fatalf("got DERP secret %q, want %q", parsed.DERPSecret, tc.secret)
+			}
+			if parsed.DERPMap.Regions[900] == nil {
+				t.Fatalf("region 900 missing from parsed DERP map %v", parsed.DERPMap.RegionIDs())
+			}
+		})
+	}
+}
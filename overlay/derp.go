@@ -0,0 +1,116 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func init() {
+	RegisterTransport("derp", derpTransport{})
+}
+
+// derpTransport exchanges messages through the receiver's home DERP region.
+// Peers are addressed by their DERP key.
+type derpTransport struct{}
+
+func (derpTransport) Name() string { return "DERP" }
+
+// Listen picks a DERP home first, unless r already has one.
+func (derpTransport) Listen(ctx context.Context, r *Receive) (ListenConn, <-chan struct{}, error) {
+	if r.DERPRegionID() == 0 {
+		err := r.PickDERPHome(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	c := derphttp.NewRegionClient(r.SelfPriv, func(format string, args ...any) {}, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return r.DerpMap.Regions[int(r.derpRegionID)]
+	})
+	ready := make(chan struct{})
+	close(ready)
+	return &derpConn{c: c, self: r.SelfPriv.Public(), admit: r.AdmitDERP}, ready, nil
+}
+
+func (derpTransport) Dial(ctx context.Context, s *Send) (DialConn, error) {
+	if s.Auth.ReceiverDERPRegionID == 0 {
+		return nil, nil
+	}
+
+	// The client reconnects by itself on the next Send or Recv after it
+	// breaks, keeping its key, so the receiver still knows us by the same
+	// address.
+	derpPriv := key.NewNode()
+	c := derphttp.NewRegionClient(derpPriv, func(format string, args ...any) {}, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return s.derpMap.Regions[int(s.Auth.ReceiverDERPRegionID)]
+	})
+	return &derpConn{
+		c:        c,
+		self:     derpPriv.Public(),
+		admit:    s.AdmitDERP,
+		receiver: s.Auth.ReceiverPublicKey,
+	}, nil
+}
+
+// derpConn is a DERP client. Dialed conns only talk to the receiver.
+type derpConn struct {
+	c     *derphttp.Client
+	self  key.NodePublic
+	admit func(context.Context, key.NodePublic) error
+	// receiver is the receiver's key, for dialed conns.
+	receiver key.NodePublic
+}
+
+func (dc *derpConn) Connect(ctx context.Context) error {
+	// Admit our key on every attempt, in case the relay restarted.
+	err := dc.admit(ctx, dc.self)
+	if err != nil {
+		return err
+	}
+	return dc.c.Connect(ctx)
+}
+
+func (dc *derpConn) Recv() (Frame, error) {
+	for {
+		msg, err := dc.c.Recv()
+		if err != nil {
+			return Frame{}, err
+		}
+
+		pkt, ok := msg.(derp.ReceivedPacket)
+		if !ok {
+			return Frame{}, nil
+		}
+		if !dc.receiver.IsZero() && pkt.Source != dc.receiver {
+			fmt.Printf("message from unknown peer %s\n", pkt.Source.String())
+			continue
+		}
+		return Frame{From: pkt.Source, Data: pkt.Data}, nil
+	}
+}
+
+func (dc *derpConn) SendTo(to PeerAddr, sealed []byte) error {
+	dst, ok := to.(key.NodePublic)
+	if !ok {
+		return errors.New("DERP peers must be addressed by their key")
+	}
+	return dc.c.Send(dst, sealed)
+}
+
+func (dc *derpConn) Send(sealed []byte) error {
+	return dc.c.Send(dc.receiver, sealed)
+}
+
+func (dc *derpConn) Close() error {
+	return dc.c.Close()
+}
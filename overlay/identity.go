@@ -0,0 +1,86 @@
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/types/key"
+)
+
+// ConnectionRequest describes a peer asking to connect to a receiver that
+// requires approval.
+type ConnectionRequest struct {
+	HostInfo HostInfo
+	// Identity is the persistent identity key of the peer. The peer has proven
+	// it holds the private key. It is zero for peers that don't send an
+	// identity, such as browsers.
+	Identity key.NodePublic
+	// KeyLabel is the label of the auth key the peer authenticated with.
+	KeyLabel string
+}
+
+// Fingerprint returns a short, human comparable fingerprint of an identity
+// key.
+func Fingerprint(pub key.NodePublic) string {
+	if pub.IsZero() {
+		return "none"
+	}
+	raw := pub.Raw32()
+	sum := sha256.Sum256(raw[:])
+
+	parts := make([]string, 8)
+	for i := range parts {
+		parts[i] = hex.EncodeToString(sum[i : i+1])
+	}
+	return strings.Join(parts, ":")
+}
+
+// DefaultIdentityPath returns where the identity key of this wush client is
+// stored by default.
+func DefaultIdentityPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("get user config dir: %w", err)
+	}
+	return filepath.Join(dir, "wush", "identity.key"), nil
+}
+
+// LoadOrCreateIdentity reads the identity key at path, generating and saving a
+// new one if it doesn't exist.
+func LoadOrCreateIdentity(path string) (key.NodePrivate, error) {
+	var priv key.NodePrivate
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = priv.UnmarshalText([]byte(strings.TrimSpace(string(data))))
+		if err != nil {
+			return key.NodePrivate{}, fmt.Errorf("parse identity key: %w", err)
+		}
+		return priv, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return key.NodePrivate{}, fmt.Errorf("read identity key: %w", err)
+	}
+
+	priv = key.NewNode()
+	text, err := priv.MarshalText()
+	if err != nil {
+		return key.NodePrivate{}, fmt.Errorf("marshal identity key: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return key.NodePrivate{}, fmt.Errorf("create identity dir: %w", err)
+	}
+	err = os.WriteFile(path, append(text, '\n'), 0o600)
+	if err != nil {
+		return key.NodePrivate{}, fmt.Errorf("write identity key: %w", err)
+	}
+	return priv, nil
+}
@@ -0,0 +1,94 @@
+package overlay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// PeerKey is a single auth key accepted by a receiver. Peers are handed the
+// private key, and the receiver enforces the policy for any peer that
+// authenticates with it.
+type PeerKey struct {
+	// Label identifies the key when listing or revoking it.
+	Label string
+	// Priv is the private key given to peers in the auth key.
+	Priv key.NodePrivate
+	// Issued is when the key was minted. It is zero for keys saved before it
+	// was recorded.
+	Issued time.Time
+
+	Policy
+}
+
+// KeyRing holds the auth keys a receiver accepts. Keys can be minted and
+// revoked while the receiver is running without affecting peers using other
+// keys.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys []*PeerKey
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{}
+}
+
+// Mint generates a new key with the given label and policy. Labels must be
+// unique within the ring.
+func (kr *KeyRing) Mint(label string, policy Policy) (*PeerKey, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for _, pk := range kr.keys {
+		if pk.Label == label {
+			return nil, fmt.Errorf("key %q already exists", label)
+		}
+	}
+
+	pk := &PeerKey{
+		Label:  label,
+		Priv:   key.NewNode(),
+		Issued: time.Now(),
+		Policy: policy,
+	}
+	kr.keys = append(kr.keys, pk)
+	return pk, nil
+}
+
+// Revoke removes the key with the given label. Peers using it can no longer
+// send overlay messages or open new sessions.
+func (kr *KeyRing) Revoke(label string) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	for i, pk := range kr.keys {
+		if pk.Label == label {
+			kr.keys = append(kr.keys[:i:i], kr.keys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the key with the given label.
+func (kr *KeyRing) Get(label string) (*PeerKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	for _, pk := range kr.keys {
+		if pk.Label == label {
+			return pk, true
+		}
+	}
+	return nil, false
+}
+
+// Keys returns all keys in the order they were minted.
+func (kr *KeyRing) Keys() []*PeerKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	return append([]*PeerKey(nil), kr.keys...)
+}
@@ -0,0 +1,98 @@
+package overlay
+
+import "testing"
+
+func TestKeyRing(t *testing.T) {
+	kr := NewKeyRing()
+	for _, label := range []string{"default", "alice"} {
+		_, err := kr.Mint(label, Policy{Scope: ScopeSSH})
+		if err != nil {
+			t.Fatalf("mint %q: %v", label, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		op   func() bool
+		// want is the result of op, and keys the labels left in the ring.
+		want bool
+		keys []string
+	}{
+		{
+			name: "MintDuplicate",
+			op: func() bool {
+				_, err := kr.Mint("alice", Policy{Scope: ScopeAll})
+				return err == nil
+			},
+			want: false,
+			keys: []string{"default", "alice"},
+		},
+		{
+			name: "GetMissing",
+			op: func() bool {
+				_, ok := kr.Get("bob")
+				return ok
+			},
+			want: false,
+			keys: []string{"default", "alice"},
+		},
+		{
+			name: "RevokeMissing",
+			op:   func() bool { return kr.Revoke("bob") },
+			want: false,
+			keys: []string{"default", "alice"},
+		},
+		{
+			name: "Revoke",
+			op:   func() bool { return kr.Revoke("default") },
+			want: true,
+			keys: []string{"alice"},
+		},
+		{
+			name: "GetRevoked",
+			op: func() bool {
+				_, ok := kr.Get("default")
+				return ok
+			},
+			want: false,
+			keys: []string{"alice"},
+		},
+		{
+			name: "MintRevokedLabel",
+			op: func() bool {
+				_, err := kr.Mint("default", Policy{Scope: ScopeCp})
+				return err == nil
+			},
+			want: true,
+			keys: []string{"alice", "default"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.op(); got != tc.want {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+
+			keys := kr.Keys()
+			if len(keys) != len(tc.keys) {
+				t.Fatalf("got %d keys, want %v", len(keys), tc.keys)
+			}
+			for i, pk := range keys {
+				if pk.Label != tc.keys[i] {
+					t.Fatalf("key %d is %q, want %q", i, pk.Label, tc.keys[i])
+				}
+				got, ok := kr.Get(pk.Label)
+				if !ok || got != pk {
+					t.Fatalf("Get(%q) didn't return the minted key", pk.Label)
+				}
+			}
+		})
+	}
+
+	pk, _ := kr.Get("default")
+	if pk.Scope != ScopeCp {
+		t.Fatalf("re-minted key has scope %s, want %s", pk.Scope, ScopeCp)
+	}
+	if pk.Issued.IsZero() {
+		t.Fatal("minted key has no issue time")
+	}
+}
@@ -0,0 +1,271 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/types/key"
+)
+
+// lanDiscoveryPort is the UDP port receivers listen on for discovery
+// broadcasts from senders on the same network. Receivers on the same host
+// share it.
+const lanDiscoveryPort = 7473
+
+const (
+	// lanQueryInterval is how often senders repeat their discovery broadcast
+	// until the receiver answers.
+	lanQueryInterval = time.Second
+	// lanDiscoveryTimeout is how long senders look for the receiver before
+	// giving up, until the overlay reconnects.
+	lanDiscoveryTimeout = 10 * time.Second
+)
+
+// lanMagic starts every LAN discovery packet, so they can't be confused with
+// sealed overlay messages.
+var lanMagic = []byte("wush-lan")
+
+// Types of LAN discovery packets.
+const (
+	// lanQuery is broadcast by senders looking for a receiver.
+	lanQuery byte = iota + 1
+	// lanAnnounce is sent by the receiver to a sender looking for it, from
+	// the socket it expects overlay messages on.
+	lanAnnounce
+)
+
+// lanPacket encodes a discovery packet: the magic, its type and the public
+// key of the receiver it is about.
+func lanPacket(typ byte, receiver key.NodePublic) []byte {
+	raw := receiver.Raw32()
+	return slices.Concat(lanMagic, []byte{typ}, raw[:])
+}
+
+// isLANDiscovery reports whether buf is a LAN discovery packet.
+func isLANDiscovery(buf []byte) bool {
+	return bytes.HasPrefix(buf, lanMagic)
+}
+
+func parseLANPacket(buf []byte) (typ byte, receiver key.NodePublic, ok bool) {
+	if len(buf) != len(lanMagic)+1+32 || !isLANDiscovery(buf) {
+		return 0, key.NodePublic{}, false
+	}
+	return buf[len(lanMagic)], key.NodePublicFromRaw32(mem.B(buf[len(lanMagic)+1:])), true
+}
+
+func init() {
+	RegisterTransport("lan", lanTransport{})
+}
+
+// lanTransport finds peers on the local network, without needing the
+// internet. Senders find the receiver by broadcasting a query for its public
+// key to lanDiscoveryPort, which it answers from the overlay socket.
+//
+// Discovery packets aren't authenticated, so anyone on the network can answer
+// in the receiver's place. Overlay messages are still sealed, so that only
+// keeps senders from reaching the receiver.
+type lanTransport struct{}
+
+func (lanTransport) Name() string { return "LAN" }
+
+func (lanTransport) Listen(ctx context.Context, r *Receive) (ListenConn, <-chan struct{}, error) {
+	lc := net.ListenConfig{Control: reuseLANDiscoveryPort}
+	pc, err := lc.ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", lanDiscoveryPort))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, nil, fmt.Errorf("listen for LAN discovery: UDP port %d is used by another program: %w", lanDiscoveryPort, err)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen for LAN discovery: %w", err)
+	}
+	disc := pc.(*net.UDPConn)
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		_ = disc.Close()
+		return nil, nil, fmt.Errorf("listen LAN: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = disc.Close()
+	}()
+
+	r.lan = true
+	go r.answerLANQueries(disc, conn)
+	ready := make(chan struct{})
+	close(ready)
+	return &udpListenConn{conn: conn, intercept: isLANDiscovery}, ready, nil
+}
+
+func (lanTransport) Dial(ctx context.Context, s *Send) (DialConn, error) {
+	if !s.Auth.ReceiverLAN {
+		return nil, nil
+	}
+	conn, err := newUDPDialConn("udp4", new(atomic.Pointer[netip.AddrPort]), s.Auth.discoverLAN)
+	if err != nil {
+		return nil, fmt.Errorf("listen LAN: %w", err)
+	}
+	return conn, nil
+}
+
+// answerLANQueries announces us over conn to senders that query disc for our
+// public key. Queries for other receivers are ignored.
+func (r *Receive) answerLANQueries(disc, conn *net.UDPConn) {
+	self := r.SelfPriv.Public()
+	announce := lanPacket(lanAnnounce, self)
+
+	for {
+		buf := make([]byte, 64)
+		n, addr, err := disc.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			r.Logger.Debug("read LAN discovery", "err", err)
+			continue
+		}
+
+		typ, receiver, ok := parseLANPacket(buf[:n])
+		if !ok || typ != lanQuery || receiver != self {
+			continue
+		}
+		_, err = conn.WriteToUDPAddrPort(announce, addr)
+		if err != nil {
+			r.Logger.Debug("answer LAN discovery", "addr", addr.String(), "err", err)
+		}
+	}
+}
+
+// discoverLAN broadcasts queries for the receiver over conn to every local
+// network, returning the address the receiver answers from. Any other packets
+// read in the meantime are dropped.
+func (ca *ClientAuth) discoverLAN(ctx context.Context, conn *net.UDPConn) (netip.AddrPort, error) {
+	ctx, cancel := context.WithTimeout(ctx, lanDiscoveryTimeout)
+	defer cancel()
+	defer conn.SetReadDeadline(time.Time{})
+
+	query := lanPacket(lanQuery, ca.ReceiverPublicKey)
+	for ctx.Err() == nil {
+		for _, addr := range lanBroadcastAddrs() {
+			// Not every network is going to let us broadcast.
+			_, _ = conn.WriteToUDPAddrPort(query, addr)
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(lanQueryInterval))
+		for {
+			buf := make([]byte, 4<<10)
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+
+			typ, receiver, ok := parseLANPacket(buf[:n])
+			if ok && typ == lanAnnounce && receiver == ca.ReceiverPublicKey {
+				return addr, nil
+			}
+		}
+	}
+	return netip.AddrPort{}, errors.New("receiver wasn't found on the local network")
+}
+
+// lanBroadcastAddrs returns the discovery port at the broadcast address of
+// every local IPv4 network, and on loopback for receivers on this machine.
+// Broadcasts only need a route to the network itself, unlike multicast which
+// fails on networks without a default route.
+func lanBroadcastAddrs() []netip.AddrPort {
+	addrs := []netip.AddrPort{netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), lanDiscoveryPort)}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		ifAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, ifAddr := range ifAddrs {
+			ipNet, ok := ifAddr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip4 := ipNet.IP.To4()
+			ones, bits := ipNet.Mask.Size()
+			if ip4 == nil || bits != 32 || ones >= 31 {
+				continue
+			}
+
+			host := binary.BigEndian.Uint32(ip4)
+			mask := binary.BigEndian.Uint32(net.CIDRMask(ones, bits))
+			var bcast [4]byte
+			binary.BigEndian.PutUint32(bcast[:], host|^mask)
+			addrs = append(addrs, netip.AddrPortFrom(netip.AddrFrom4(bcast), lanDiscoveryPort))
+		}
+	}
+	return addrs
+}
+
+// ProbeLAN finds the receiver on the local network and pings it there. The
+// result's Addr is where it was found.
+func (ca *ClientAuth) ProbeLAN(ctx context.Context) (ProbeResult, error) {
+	var res ProbeResult
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return res, fmt.Errorf("listen UDP: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	res.Addr, err = ca.discoverLAN(ctx, conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return res, errors.New("receiver wasn't found on the local network")
+		}
+		return res, err
+	}
+
+	start := time.Now()
+	_, err = conn.WriteToUDPAddrPort(ca.pingPacket(), res.Addr)
+	if err != nil {
+		return res, fmt.Errorf("send ping over LAN: %w", err)
+	}
+
+	for {
+		buf := make([]byte, 4<<10)
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return res, errors.New("receiver did not answer over LAN")
+			}
+			return res, err
+		}
+		if addr != res.Addr || !ca.isPong(buf[:n]) {
+			continue
+		}
+		res.ReceiverRTT = time.Since(start)
+		return res, nil
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows && !js && !wasm
+// +build !windows,!js,!wasm
+
+package overlay
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reuseLANDiscoveryPort lets every receiver on the host bind
+// lanDiscoveryPort. Queries are broadcast, so each of them still gets them.
+func reuseLANDiscoveryPort(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
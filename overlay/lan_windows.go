@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package overlay
+
+import "syscall"
+
+// reuseLANDiscoveryPort lets every receiver on the host bind
+// lanDiscoveryPort. Queries are broadcast, so each of them still gets them.
+func reuseLANDiscoveryPort(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -1,11 +1,18 @@
 package overlay
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/netip"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/webrtc/v4"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 type Logf func(format string, args ...any)
@@ -13,10 +20,16 @@ type Logf func(format string, args ...any)
 // Overlay specifies the mechanism by which senders and receivers exchange
 // Tailscale nodes over a sidechannel.
 type Overlay interface {
-	// listenOverlay(ctx context.Context, kind string) error
 	Recv() <-chan *tailcfg.Node
+	// Removed returns the node keys of peers that have gone away.
+	Removed() <-chan key.NodePublic
 	SendTailscaleNodeUpdate(node *tailcfg.Node)
-	IPs() []netip.Addr
+	// IPs returns our tailnet addresses. Senders are assigned some by the
+	// receiver, so they wait for it to answer until ctx is done.
+	IPs(ctx context.Context) ([]netip.Addr, error)
+	// AdmitDERP lets nodeKey connect to the DERP relays, if they require a
+	// shared secret.
+	AdmitDERP(ctx context.Context, nodeKey key.NodePublic) error
 }
 
 type messageType int
@@ -31,16 +44,181 @@ const (
 	messageTypeWebRTCOffer
 	messageTypeWebRTCAnswer
 	messageTypeWebRTCCandidate
+
+	messageTypeIdentityChallenge
+	messageTypeIdentityProof
+	messageTypeHelloDenied
+	messageTypeHelloIncompatible
+	messageTypeGoodbye
+	messageTypeAddrUpdate
+)
+
+// keepAliveInterval is how often senders ping the receiver over each overlay.
+// An overlay is considered dead once nothing has been heard over it for
+// deadAfter.
+const (
+	keepAliveInterval = 30 * time.Second
+	deadAfter         = 3 * keepAliveInterval
 )
 
+// protocolVersion is the version of the overlay protocol spoken by this build,
+// exchanged in the Hello and HelloResponse. Peers from before the protocol was
+// versioned don't send one and are treated as version 0.
+//
+// minProtocolVersion is the oldest version this build can still talk to. It is
+// only raised for changes that can't be made backwards compatible; everything
+// else should be an optional feature.
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 0
+)
+
+// Optional features of the overlay protocol, advertised in the Hello and
+// HelloResponse. A feature is only used if both peers advertise it.
+const (
+	// featureIdentity is answering identity challenges.
+	featureIdentity = "identity"
+	// featureSessions is joining a session over multiple overlays.
+	featureSessions = "sessions"
+	// featureKeepAlive is pinging every keepAliveInterval over every
+	// overlay, so the receiver can tell when the sender is gone.
+	featureKeepAlive = "keepalive"
+	// featureSessionKeys is sealing messages after the Hello with a per
+	// sender session key, rather than the auth key shared by all senders.
+	featureSessionKeys = "sessionkeys"
+)
+
+// cliFeatures are the features supported by the wush CLI.
+var cliFeatures = []string{featureIdentity, featureSessions, featureKeepAlive, featureSessionKeys}
+
+// ErrIncompatible is returned when the peer speaks a version of the overlay
+// protocol we can't talk to.
+var ErrIncompatible = errors.New("peer speaks an incompatible version of the overlay protocol; upgrade wush on both ends")
+
+// withProtocol sets the protocol version and features of a Hello,
+// HelloResponse or HelloIncompatible.
+func (m overlayMessage) withProtocol(features []string) overlayMessage {
+	m.ProtocolVersion = protocolVersion
+	m.MinProtocolVersion = minProtocolVersion
+	m.Features = features
+	return m
+}
+
+// checkProtocol returns an error wrapping ErrIncompatible if the peer that sent
+// msg can't talk to us.
+func checkProtocol(msg overlayMessage) error {
+	if msg.ProtocolVersion < minProtocolVersion || msg.MinProtocolVersion > protocolVersion {
+		return fmt.Errorf("%w (peer speaks versions %d to %d, we speak %d to %d)",
+			ErrIncompatible,
+			msg.MinProtocolVersion, msg.ProtocolVersion,
+			minProtocolVersion, protocolVersion,
+		)
+	}
+	return nil
+}
+
+// negotiateFeatures returns the features supported by both us and the peer.
+func negotiateFeatures(ours, peers []string) []string {
+	var features []string
+	for _, f := range ours {
+		if slices.Contains(peers, f) {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
 type overlayMessage struct {
 	Typ messageType
 
+	// ProtocolVersion and MinProtocolVersion are the range of overlay
+	// protocol versions the sender speaks, sent in the Hello, HelloResponse
+	// and HelloIncompatible.
+	ProtocolVersion    int `json:",omitempty"`
+	MinProtocolVersion int `json:",omitempty"`
+	// Features are the optional protocol features the sender supports.
+	Features []string `json:",omitempty"`
+	// Seq and Timestamp let peers reject replayed messages. Seq increases
+	// with every message a peer seals, and Timestamp is when it was sealed in
+	// Unix milliseconds.
+	Seq       uint64 `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+
 	HostInfo HostInfo
 	Node     tailcfg.Node
 
 	WebrtcDescription *webrtc.SessionDescription
 	WebrtcCandidate   *webrtc.ICECandidateInit
+
+	// SessionID identifies a sender across the overlays it is connected
+	// over. It is sent with every message, so replays can be tracked across
+	// overlays.
+	SessionID string `json:",omitempty"`
+	// Identity is the sender's persistent identity key, sent in the Hello.
+	Identity key.NodePublic
+	// SessionKey is the sender's ephemeral session key, sent in the Hello.
+	// Everything after the Hello is sealed with it in both directions.
+	SessionKey key.NodePublic
+	// Challenge is a nonce the sender must seal with its identity key to
+	// prove it holds it.
+	Challenge []byte `json:",omitempty"`
+	// IdentityProof is the Challenge sealed from the identity key to the
+	// receiver.
+	IdentityProof []byte `json:",omitempty"`
+	// STUNAddr is the receiver's new STUN address, sent in an AddrUpdate
+	// when its NAT mapping changes.
+	STUNAddr *netip.AddrPort `json:",omitempty"`
+	// IPv4 is the tailnet IPv4 address the receiver assigned to the sender,
+	// sent in HelloResponses.
+	IPv4 *netip.Addr `json:",omitempty"`
+}
+
+// String returns the name of the message type, for logging.
+func (t messageType) String() string {
+	switch t {
+	case messageTypePing:
+		return "ping"
+	case messageTypePong:
+		return "pong"
+	case messageTypeHello:
+		return "hello"
+	case messageTypeHelloResponse:
+		return "hello response"
+	case messageTypeNodeUpdate:
+		return "node update"
+	case messageTypeWebRTCOffer:
+		return "webrtc offer"
+	case messageTypeWebRTCAnswer:
+		return "webrtc answer"
+	case messageTypeWebRTCCandidate:
+		return "webrtc candidate"
+	case messageTypeIdentityChallenge:
+		return "identity challenge"
+	case messageTypeIdentityProof:
+		return "identity proof"
+	case messageTypeHelloDenied:
+		return "hello denied"
+	case messageTypeHelloIncompatible:
+		return "hello incompatible"
+	case messageTypeGoodbye:
+		return "goodbye"
+	case messageTypeAddrUpdate:
+		return "addr update"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(t))
+	}
+}
+
+// decodeOverlayMessage decodes the cleartext of an overlay message. Messages
+// of types we don't know decode fine and should be ignored by the caller, so
+// newer peers can add them.
+func decodeOverlayMessage(cleartext []byte) (overlayMessage, error) {
+	var msg overlayMessage
+	err := json.Unmarshal(cleartext, &msg)
+	if err != nil {
+		return overlayMessage{}, fmt.Errorf("decode overlay message: %w", err)
+	}
+	return msg, nil
 }
 
 type HostInfo struct {
@@ -48,8 +226,40 @@ type HostInfo struct {
 	Hostname string
 }
 
+// String returns the host info as user@host, using "unknown" for missing
+// parts.
+func (hi HostInfo) String() string {
+	username := "unknown"
+	if hi.Username != "" {
+		username = hi.Username
+	}
+	hostname := "unknown"
+	if hi.Hostname != "" {
+		hostname = hi.Hostname
+	}
+	return fmt.Sprintf("%s@%s", username, hostname)
+}
+
+// nameNode names node after the host its peer said hello from, which tsserver
+// derives the peer's MagicDNS name from. Nodes of peers that didn't say keep
+// their own name.
+func nameNode(node *tailcfg.Node, hi HostInfo) {
+	if hi.Hostname != "" {
+		node.Name = hi.Hostname
+	}
+}
+
 var TailscaleServicePrefix6 = [6]byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0}
 
+var (
+	// TailnetIPv4Prefix is the CGNAT range tailnet IPv4 addresses are
+	// assigned from, like Tailscale does.
+	TailnetIPv4Prefix = netip.MustParsePrefix("100.64.0.0/10")
+	// ReceiverIPv4 is the tailnet IPv4 address of receivers. Senders are
+	// assigned the others by the receiver.
+	ReceiverIPv4 = netip.AddrFrom4([4]byte{100, 64, 0, 1})
+)
+
 func randv6() netip.Addr {
 	uid := uuid.New()
 	copy(uid[:], TailscaleServicePrefix6[:])
@@ -0,0 +1,436 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go4.org/mem"
+	"golang.org/x/crypto/nacl/secretbox"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+
+	"github.com/coder/wush/cliui"
+)
+
+type pairingMessageType int
+
+const (
+	pairingMessageTypeLookup pairingMessageType = 1 + iota
+	pairingMessageTypeAnnounce
+	pairingMessageTypePake
+	pairingMessageTypeConfirm
+	pairingMessageTypeAuthKey
+	pairingMessageTypeFailed
+)
+
+// pairingMessage is exchanged in the clear over DERP. Its contents are either
+// PAKE messages, which are safe to reveal, or encrypted with the PAKE key.
+type pairingMessage struct {
+	Typ  pairingMessageType
+	Body []byte
+}
+
+const (
+	// pairingTimeout is how long a sender waits for the receiver to complete
+	// the pairing exchange.
+	pairingTimeout = 30 * time.Second
+	// pairingClaimAttempts is how many nameplates a receiver tries before
+	// giving up.
+	pairingClaimAttempts = 5
+)
+
+// pairingProbeTimeout is how long a receiver waits for another receiver to
+// answer a lookup for a nameplate before taking it.
+var pairingProbeTimeout = time.Second
+
+// pairingNameplate returns the DERP region both sides of a pairing code meet
+// in, and the key the receiver answers lookups for the code's nameplate on. The
+// region is the receiver's DERP home, which is encoded in the code. The key is
+// derived from the public parts of the code only, so anyone can hold it. It
+// only tells senders the random key the receiver pairs from, and without the
+// code's words whoever answers in its place can't complete the PAKE.
+func pairingNameplate(dm *tailcfg.DERPMap, pc PairingCode) (*tailcfg.DERPRegion, key.NodePrivate, error) {
+	region := dm.Regions[int(pc.Region)]
+	if region == nil {
+		return nil, key.NodePrivate{}, fmt.Errorf("DERP region %d of the pairing code is not in the DERP map", pc.Region)
+	}
+
+	seed := sha256.Sum256([]byte(fmt.Sprintf("wush pairing nameplate %d-%d", pc.Region, pc.Nameplate)))
+	return region, key.NodePrivateFromRaw32(mem.B(seed[:])), nil
+}
+
+func pairingConfirmation(pakeKey []byte) []byte {
+	mac := hmac.New(sha256.New, pakeKey)
+	mac.Write([]byte("wush pairing confirm"))
+	return mac.Sum(nil)
+}
+
+func pairingBoxKey(pakeKey []byte) *[32]byte {
+	mac := hmac.New(sha256.New, pakeKey)
+	mac.Write([]byte("wush pairing box"))
+	var boxKey [32]byte
+	copy(boxKey[:], mac.Sum(nil))
+	return &boxKey
+}
+
+func sendPairingMessage(c *derphttp.Client, dst key.NodePublic, typ pairingMessageType, body []byte) error {
+	raw, err := json.Marshal(pairingMessage{Typ: typ, Body: body})
+	if err != nil {
+		panic("marshal pairing msg: " + err.Error())
+	}
+	return c.Send(dst, raw)
+}
+
+// connectPairingClient connects to region as priv until ctx is done.
+func connectPairingClient(ctx context.Context, region *tailcfg.DERPRegion, priv key.NodePrivate) (*derphttp.Client, error) {
+	c := derphttp.NewRegionClient(priv, logger.Discard, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return region
+	})
+
+	err := c.Connect(ctx)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("connect to pairing relay: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+	return c, nil
+}
+
+type pairingPacket struct {
+	src key.NodePublic
+	msg pairingMessage
+}
+
+// recvPairingMessages reads pairing messages from c until it is closed, which
+// closes the returned channel.
+func recvPairingMessages(c *derphttp.Client) <-chan pairingPacket {
+	pkts := make(chan pairingPacket, 8)
+	go func() {
+		defer close(pkts)
+		for {
+			msg, err := c.Recv()
+			if err != nil {
+				return
+			}
+
+			pkt, ok := msg.(derp.ReceivedPacket)
+			if !ok {
+				continue
+			}
+			var pm pairingMessage
+			if err := json.Unmarshal(pkt.Data, &pm); err != nil {
+				continue
+			}
+			pkts <- pairingPacket{src: pkt.Source, msg: pm}
+		}
+	}()
+	return pkts
+}
+
+// PairingListener holds a pairing code's nameplate until a sender redeems the
+// code.
+type PairingListener struct {
+	r    *Receive
+	code PairingCode
+
+	// lookup holds the nameplate's key, and answers lookups for it with
+	// exchange, a random key the PAKE is run from.
+	lookup       *derphttp.Client
+	exchange     *derphttp.Client
+	exchangePkts <-chan pairingPacket
+	cancel       context.CancelFunc
+}
+
+// ListenPairing generates a pairing code that meets in r's DERP home, picking
+// one first unless r already has one, and takes its nameplate. Nameplates held
+// by other receivers are skipped.
+func (r *Receive) ListenPairing(ctx context.Context) (*PairingListener, error) {
+	if r.derpRegionID == 0 {
+		err := r.PickDERPHome(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("pick DERP home: %w", err)
+		}
+	}
+	return r.listenPairing(ctx, func() PairingCode {
+		return NewPairingCode(r.derpRegionID)
+	})
+}
+
+func (r *Receive) listenPairing(ctx context.Context, newCode func() PairingCode) (_ *PairingListener, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	region := r.DerpMap.Regions[int(r.derpRegionID)]
+	if region == nil {
+		return nil, fmt.Errorf("DERP region %d is not in the DERP map", r.derpRegionID)
+	}
+	exchange, err := connectPairingClient(ctx, region, key.NewNode())
+	if err != nil {
+		return nil, err
+	}
+	exchangePkts := recvPairingMessages(exchange)
+
+	for range pairingClaimAttempts {
+		pc := newCode()
+		_, nameplatePriv, err := pairingNameplate(r.DerpMap, pc)
+		if err != nil {
+			return nil, err
+		}
+
+		taken, err := probePairingNameplate(ctx, exchange, exchangePkts, nameplatePriv.Public())
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			continue
+		}
+
+		lookup, err := connectPairingClient(ctx, region, nameplatePriv)
+		if err != nil {
+			return nil, err
+		}
+		return &PairingListener{
+			r:            r,
+			code:         pc,
+			lookup:       lookup,
+			exchange:     exchange,
+			exchangePkts: exchangePkts,
+			cancel:       cancel,
+		}, nil
+	}
+	return nil, errors.New("every pairing code tried is held by another receiver")
+}
+
+// probePairingNameplate looks up nameplate from c, and reports whether another
+// receiver answers before pairingProbeTimeout.
+func probePairingNameplate(ctx context.Context, c *derphttp.Client, pkts <-chan pairingPacket, nameplate key.NodePublic) (bool, error) {
+	err := sendPairingMessage(c, nameplate, pairingMessageTypeLookup, nil)
+	if err != nil {
+		return false, fmt.Errorf("send pairing lookup: %w", err)
+	}
+
+	timeout := time.NewTimer(pairingProbeTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timeout.C:
+			return false, nil
+		case pkt, ok := <-pkts:
+			if !ok {
+				return false, errors.New("lost connection to pairing relay")
+			}
+			if pkt.msg.Typ == pairingMessageTypeAnnounce {
+				return true, nil
+			}
+		}
+	}
+}
+
+// Code returns the pairing code to give to the sender.
+func (l *PairingListener) Code() PairingCode {
+	return l.code
+}
+
+// Close releases the nameplate. The code can't be redeemed afterwards.
+func (l *PairingListener) Close() error {
+	l.cancel()
+	return nil
+}
+
+// Serve waits for a single sender to redeem the pairing code and sends it the
+// auth key for pk. The code is burned after the first attempt, whether it
+// succeeds or not, so an attacker only gets a single online guess.
+func (l *PairingListener) Serve(ctx context.Context, pk *PeerKey) error {
+	defer l.Close()
+	lookups := recvPairingMessages(l.lookup)
+
+	var (
+		sender  key.NodePublic
+		pakeKey []byte
+	)
+
+	for {
+		var (
+			pkt pairingPacket
+			ok  bool
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case lookup, ok := <-lookups:
+			if !ok {
+				return errors.New("lost connection to pairing relay")
+			}
+			if lookup.msg.Typ == pairingMessageTypeLookup {
+				_ = sendPairingMessage(l.exchange, lookup.src, pairingMessageTypeAnnounce, nil)
+			}
+			continue
+
+		case pkt, ok = <-l.exchangePkts:
+			if !ok {
+				return errors.New("lost connection to pairing relay")
+			}
+		}
+
+		// Only a single sender may attempt the exchange.
+		if !sender.IsZero() && pkt.src != sender {
+			continue
+		}
+
+		switch pkt.msg.Typ {
+		case pairingMessageTypePake:
+			if !sender.IsZero() {
+				continue
+			}
+			sender = pkt.src
+
+			pake := newSpake2(l.code.String(), false)
+			var err error
+			pakeKey, err = pake.Finish(pkt.msg.Body)
+			if err != nil {
+				_ = sendPairingMessage(l.exchange, sender, pairingMessageTypeFailed, nil)
+				return fmt.Errorf("pairing failed: %w", err)
+			}
+
+			err = sendPairingMessage(l.exchange, sender, pairingMessageTypePake, pake.Message())
+			if err != nil {
+				return fmt.Errorf("send pairing message: %w", err)
+			}
+
+		case pairingMessageTypeConfirm:
+			if pakeKey == nil {
+				continue
+			}
+
+			if !hmac.Equal(pkt.msg.Body, pairingConfirmation(pakeKey)) {
+				_ = sendPairingMessage(l.exchange, sender, pairingMessageTypeFailed, nil)
+				return errors.New("pairing failed; sender used the wrong code")
+			}
+
+			var nonce [24]byte
+			if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+				return fmt.Errorf("read random: %w", err)
+			}
+
+			authKey, err := l.r.ClientAuth(pk).AuthKey()
+			if err != nil {
+				_ = sendPairingMessage(l.exchange, sender, pairingMessageTypeFailed, nil)
+				return fmt.Errorf("encode auth key: %w", err)
+			}
+			sealed := secretbox.Seal(nonce[:], []byte(authKey), &nonce, pairingBoxKey(pakeKey))
+			err = sendPairingMessage(l.exchange, sender, pairingMessageTypeAuthKey, sealed)
+			if err != nil {
+				return fmt.Errorf("send auth key: %w", err)
+			}
+
+			l.r.HumanLogf("%s Pairing code %s redeemed", cliui.Timestamp(time.Now()), cliui.Code(l.code.String()))
+			return nil
+		}
+	}
+}
+
+// RedeemPairingCode exchanges a pairing code for the receiver's auth key. The
+// receiver is looked up by the code's nameplate, and the first to answer is the
+// only one the PAKE is run with.
+func RedeemPairingCode(ctx context.Context, dm *tailcfg.DERPMap, pc PairingCode) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, pairingTimeout)
+	defer cancel()
+
+	region, nameplatePriv, err := pairingNameplate(dm, pc)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := connectPairingClient(ctx, region, key.NewNode())
+	if err != nil {
+		return "", err
+	}
+	pkts := recvPairingMessages(c)
+
+	err = sendPairingMessage(c, nameplatePriv.Public(), pairingMessageTypeLookup, nil)
+	if err != nil {
+		return "", fmt.Errorf("send pairing lookup: %w", err)
+	}
+
+	var (
+		pake     = newSpake2(pc.String(), true)
+		receiver key.NodePublic
+		pakeKey  []byte
+	)
+	for pkt := range pkts {
+		if pkt.msg.Typ == pairingMessageTypeAnnounce {
+			if !receiver.IsZero() {
+				continue
+			}
+			receiver = pkt.src
+
+			err = sendPairingMessage(c, receiver, pairingMessageTypePake, pake.Message())
+			if err != nil {
+				return "", fmt.Errorf("send pairing message: %w", err)
+			}
+			continue
+		}
+		if receiver.IsZero() || pkt.src != receiver {
+			continue
+		}
+
+		switch pkt.msg.Typ {
+		case pairingMessageTypePake:
+			pakeKey, err = pake.Finish(pkt.msg.Body)
+			if err != nil {
+				return "", fmt.Errorf("pairing failed: %w", err)
+			}
+
+			err = sendPairingMessage(c, receiver, pairingMessageTypeConfirm, pairingConfirmation(pakeKey))
+			if err != nil {
+				return "", fmt.Errorf("send pairing confirmation: %w", err)
+			}
+
+		case pairingMessageTypeAuthKey:
+			if pakeKey == nil || len(pkt.msg.Body) < 24 {
+				continue
+			}
+
+			var nonce [24]byte
+			copy(nonce[:], pkt.msg.Body[:24])
+
+			authKey, ok := secretbox.Open(nil, pkt.msg.Body[24:], &nonce, pairingBoxKey(pakeKey))
+			if !ok {
+				return "", errors.New("pairing failed; could not decrypt auth key")
+			}
+			return string(authKey), nil
+
+		case pairingMessageTypeFailed:
+			return "", errors.New("pairing failed; the code is wrong or has already been used")
+		}
+	}
+	if ctx.Err() != nil {
+		return "", errors.New("timed out waiting for receiver; is the pairing code correct?")
+	}
+	return "", errors.New("lost connection to pairing relay")
+}
@@ -0,0 +1,188 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// newTestDERP runs a DERP server for the test, in region 1 of the returned map.
+func newTestDERP(t *testing.T) *tailcfg.DERPMap {
+	d := derp.NewServer(key.NewNode(), t.Logf)
+	srv := httptest.NewUnstartedServer(derphttp.Handler(d))
+	srv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	srv.StartTLS()
+	t.Cleanup(func() {
+		srv.CloseClientConnections()
+		srv.Close()
+		_ = d.Close()
+	})
+
+	return &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		1: {
+			RegionID:   1,
+			RegionCode: "test",
+			Nodes: []*tailcfg.DERPNode{{
+				Name:             "1a",
+				RegionID:         1,
+				HostName:         "127.0.0.1",
+				IPv4:             "127.0.0.1",
+				IPv6:             "none",
+				DERPPort:         srv.Listener.Addr().(*net.TCPAddr).Port,
+				InsecureForTests: true,
+			}},
+		},
+	}}
+}
+
+func newPairingReceiver(t *testing.T, dm *tailcfg.DERPMap) (*Receive, *PeerKey) {
+	// Nobody else is on the test relay.
+	probeTimeout := pairingProbeTimeout
+	pairingProbeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { pairingProbeTimeout = probeTimeout })
+
+	r := NewReceiveOverlay(slog.New(slog.NewTextHandler(io.Discard, nil)), t.Logf, dm)
+	r.derpRegionID = 1
+	pk, err := r.Keys.Mint("default", Policy{Scope: ScopeAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, pk
+}
+
+func TestPairing(t *testing.T) {
+	dm := newTestDERP(t)
+
+	for _, tc := range []struct {
+		name string
+		// redeem changes the code the sender uses on each attempt, and the
+		// attempts are made in order.
+		redeem  []func(PairingCode) PairingCode
+		wantKey []bool
+	}{
+		{
+			name:    "Redeem",
+			redeem:  []func(PairingCode) PairingCode{samePairingCode},
+			wantKey: []bool{true},
+		},
+		{
+			name:    "WrongCode",
+			redeem:  []func(PairingCode) PairingCode{wrongPairingWord},
+			wantKey: []bool{false},
+		},
+		{
+			name:    "BurnedAfterWrongCode",
+			redeem:  []func(PairingCode) PairingCode{wrongPairingWord, samePairingCode},
+			wantKey: []bool{false, false},
+		},
+		{
+			name:    "BurnedAfterRedeem",
+			redeem:  []func(PairingCode) PairingCode{samePairingCode, samePairingCode},
+			wantKey: []bool{true, false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			r, pk := newPairingReceiver(t, dm)
+			pl, err := r.ListenPairing(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			served := make(chan error, 1)
+			go func() { served <- pl.Serve(ctx, pk) }()
+			wantAuthKey, err := r.ClientAuth(pk).AuthKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, redeem := range tc.redeem {
+				redeemCtx := ctx
+				if i > 0 {
+					// A burned code is never answered.
+					var cancel context.CancelFunc
+					redeemCtx, cancel = context.WithTimeout(ctx, 500*time.Millisecond)
+					defer cancel()
+				}
+
+				authKey, err := RedeemPairingCode(redeemCtx, dm, redeem(pl.Code()))
+				if !tc.wantKey[i] {
+					if err == nil {
+						t.Fatalf("attempt %d redeemed the code", i+1)
+					}
+				} else if err != nil {
+					t.Fatalf("attempt %d: %v", i+1, err)
+				} else if authKey != wantAuthKey {
+					t.Fatalf("attempt %d got auth key %q, want %q", i+1, authKey, wantAuthKey)
+				}
+
+				if i == 0 {
+					err := <-served
+					if tc.wantKey[0] != (err == nil) {
+						t.Fatalf("receiver returned %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPairingNameplateTaken(t *testing.T) {
+	dm := newTestDERP(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	r1, _ := newPairingReceiver(t, dm)
+	pl1, err := r1.ListenPairing(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl1.Close()
+	go func() { _ = pl1.Serve(ctx, nil) }()
+
+	// The second receiver draws the first one's nameplate before a free one.
+	taken, free := pl1.Code(), pl1.Code()
+	free.Nameplate = taken.Nameplate%9999 + 1
+	codes := []PairingCode{taken, free}
+	r2, _ := newPairingReceiver(t, dm)
+	// Give the first receiver time to answer.
+	pairingProbeTimeout = time.Second
+	pl2, err := r2.listenPairing(ctx, func() PairingCode {
+		pc := codes[0]
+		codes = codes[1:]
+		return pc
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl2.Close()
+	if pl2.Code().Nameplate != free.Nameplate {
+		t.Fatalf("got nameplate %d, want %d", pl2.Code().Nameplate, free.Nameplate)
+	}
+}
+
+func samePairingCode(pc PairingCode) PairingCode { return pc }
+
+func wrongPairingWord(pc PairingCode) PairingCode {
+	if pc.Words[1] == pairingWords[0] {
+		pc.Words[1] = pairingWords[1]
+	} else {
+		pc.Words[1] = pairingWords[0]
+	}
+	return pc
+}
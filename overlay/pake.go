@@ -0,0 +1,200 @@
+package overlay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PairingCode is a short, human-typable code that can be exchanged for a full
+// auth key, such as 21-7-purple-sausage. The region is the receiver's DERP
+// home, where both sides meet, and the nameplate is used to find the receiver
+// there. Neither is secret, while the words are the password for a PAKE that
+// protects the exchange against offline guessing.
+type PairingCode struct {
+	Region    uint16
+	Nameplate uint16
+	Words     [2]string
+}
+
+// NewPairingCode generates a random pairing code that meets in the given DERP
+// region.
+func NewPairingCode(region uint16) PairingCode {
+	return PairingCode{
+		Region:    region,
+		Nameplate: uint16(randIntN(9999)) + 1,
+		Words: [2]string{
+			pairingWords[randIntN(len(pairingWords))],
+			pairingWords[randIntN(len(pairingWords))],
+		},
+	}
+}
+
+// ParsePairingCode parses a pairing code in the format returned by
+// PairingCode.String.
+func ParsePairingCode(code string) (PairingCode, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(parts) != 4 {
+		return PairingCode{}, errors.New("pairing code should be in the format <region>-<number>-<word>-<word>")
+	}
+
+	region, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil || region == 0 {
+		return PairingCode{}, fmt.Errorf("invalid pairing code region %q", parts[0])
+	}
+
+	nameplate, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || nameplate == 0 {
+		return PairingCode{}, fmt.Errorf("invalid pairing code number %q", parts[1])
+	}
+
+	pc := PairingCode{Region: uint16(region), Nameplate: uint16(nameplate)}
+	for i, word := range parts[2:] {
+		if !isPairingWord(word) {
+			return PairingCode{}, fmt.Errorf("unknown pairing code word %q", word)
+		}
+		pc.Words[i] = word
+	}
+	return pc, nil
+}
+
+func (pc PairingCode) String() string {
+	return fmt.Sprintf("%d-%d-%s-%s", pc.Region, pc.Nameplate, pc.Words[0], pc.Words[1])
+}
+
+func randIntN(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic("read random: " + err.Error())
+	}
+	return int(i.Int64())
+}
+
+func isPairingWord(word string) bool {
+	for _, w := range pairingWords {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// pakeM and pakeN are the SPAKE2 blinding points. They are derived by hashing
+// to the curve so that nobody knows their discrete logarithm.
+var (
+	pakeM = hashToPoint("wush spake2 M")
+	pakeN = hashToPoint("wush spake2 N")
+)
+
+func hashToPoint(seed string) *edwards25519.Point {
+	for i := 0; ; i++ {
+		h := sha256.Sum256([]byte(fmt.Sprintf("%s %d", seed, i)))
+		p, err := new(edwards25519.Point).SetBytes(h[:])
+		if err != nil {
+			continue
+		}
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return p
+	}
+}
+
+// spake2 implements the SPAKE2 balanced PAKE over edwards25519. The sender of
+// the pairing code is side A and the receiver is side B.
+type spake2 struct {
+	sideA bool
+	w     *edwards25519.Scalar
+	x     *edwards25519.Scalar
+	msg   []byte
+}
+
+func newSpake2(password string, sideA bool) *spake2 {
+	pwHash := sha512.Sum512([]byte("wush pairing password " + password))
+	w, err := edwards25519.NewScalar().SetUniformBytes(pwHash[:])
+	if err != nil {
+		panic("derive password scalar: " + err.Error())
+	}
+
+	var xBytes [64]byte
+	if _, err := io.ReadFull(rand.Reader, xBytes[:]); err != nil {
+		panic("read random: " + err.Error())
+	}
+	x, err := edwards25519.NewScalar().SetUniformBytes(xBytes[:])
+	if err != nil {
+		panic("derive ephemeral scalar: " + err.Error())
+	}
+
+	blind := pakeM
+	if !sideA {
+		blind = pakeN
+	}
+
+	// X = x*G + w*M for side A, Y = y*G + w*N for side B.
+	msg := new(edwards25519.Point).ScalarBaseMult(x)
+	msg.Add(msg, new(edwards25519.Point).ScalarMult(w, blind))
+
+	return &spake2{
+		sideA: sideA,
+		w:     w,
+		x:     x,
+		msg:   msg.Bytes(),
+	}
+}
+
+// Message returns the message to send to the other side.
+func (s *spake2) Message() []byte {
+	return s.msg
+}
+
+// Finish computes the shared key from the other side's message. Both sides
+// only derive the same key if they used the same password.
+func (s *spake2) Finish(peerMsg []byte) ([]byte, error) {
+	peer, err := new(edwards25519.Point).SetBytes(peerMsg)
+	if err != nil {
+		return nil, fmt.Errorf("decode peer message: %w", err)
+	}
+
+	unblind := pakeN
+	if !s.sideA {
+		unblind = pakeM
+	}
+
+	k := new(edwards25519.Point).Subtract(peer, new(edwards25519.Point).ScalarMult(s.w, unblind))
+	k.MultByCofactor(k)
+	k.ScalarMult(s.x, k)
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, errors.New("invalid peer message")
+	}
+
+	msgA, msgB := s.msg, peerMsg
+	if !s.sideA {
+		msgA, msgB = peerMsg, s.msg
+	}
+
+	transcript := new(bytes.Buffer)
+	for _, b := range [][]byte{msgA, msgB, k.Bytes(), s.w.Bytes()} {
+		_ = binary.Write(transcript, binary.BigEndian, uint32(len(b)))
+		transcript.Write(b)
+	}
+	sum := sha256.Sum256(transcript.Bytes())
+
+	key := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, sum[:], nil, []byte("wush pairing key")), key)
+	if err != nil {
+		return nil, fmt.Errorf("derive pairing key: %w", err)
+	}
+	return key, nil
+}
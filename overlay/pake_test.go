@@ -0,0 +1,51 @@
+package overlay
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSpake2(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		passwordA string
+		passwordB string
+		wantEqual bool
+	}{
+		{name: "SamePassword", passwordA: "21-7-purple-sausage", passwordB: "21-7-purple-sausage", wantEqual: true},
+		{name: "WrongPassword", passwordA: "21-7-purple-sausage", passwordB: "21-7-purple-sandwich"},
+		{name: "WrongNameplate", passwordA: "21-7-purple-sausage", passwordB: "21-8-purple-sausage"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := newSpake2(tc.passwordA, true), newSpake2(tc.passwordB, false)
+			keyA, err := a.Finish(b.Message())
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyB, err := b.Finish(a.Message())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := bytes.Equal(keyA, keyB); got != tc.wantEqual {
+				t.Fatalf("keys equal: %v, want %v", got, tc.wantEqual)
+			}
+		})
+	}
+}
+
+func TestSpake2InvalidMessage(t *testing.T) {
+	a := newSpake2("21-7-purple-sausage", true)
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+	}{
+		{name: "Empty"},
+		{name: "Short", msg: []byte{1, 2, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := a.Finish(tc.msg); err == nil {
+				t.Fatal("finished with an invalid message")
+			}
+		})
+	}
+}
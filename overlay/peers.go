@@ -0,0 +1,149 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"tailscale.com/types/key"
+
+	"github.com/coder/wush/cliui"
+)
+
+func (r *Receive) Removed() <-chan key.NodePublic {
+	return r.removed
+}
+
+// startEviction starts removing peers that have stopped pinging us, if it
+// isn't running already.
+func (r *Receive) startEviction(ctx context.Context) {
+	r.evictOnce.Do(func() {
+		go r.evictIdlePeers(ctx)
+	})
+}
+
+func (r *Receive) evictIdlePeers(ctx context.Context) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.removeIdlePeers()
+		}
+	}
+}
+
+// removeIdlePeers removes the overlay addresses we haven't heard from for
+// deadAfter.
+func (r *Receive) removeIdlePeers() {
+	r.seen.Range(func(srcAddr string, seen time.Time) bool {
+		if time.Since(seen) < deadAfter {
+			return true
+		}
+		// Peers that don't ping can only leave with a Goodbye, but addresses
+		// that never joined a session are always forgotten.
+		if sess, ok := r.sessions.Load(r.sessionID(srcAddr)); ok && !sess.keepAlive {
+			if _, joined := r.addrSession.Load(srcAddr); joined {
+				return true
+			}
+		}
+		r.removeAddr(srcAddr)
+		return true
+	})
+}
+
+// removeAddr forgets an overlay address of a peer. Once a session has no
+// addresses left, the peer is removed.
+func (r *Receive) removeAddr(srcAddr string) {
+	r.seen.Delete(srcAddr)
+	r.pending.Delete(srcAddr)
+	// Senders that predate sessions, and messages that claim a session they
+	// weren't sealed for, are tracked by overlay address.
+	time.AfterFunc(maxMessageAge, func() {
+		r.replay.Delete(srcAddr)
+	})
+	sessionID, ok := r.addrSession.LoadAndDelete(srcAddr)
+	if !ok {
+		return
+	}
+	sess, ok := r.sessions.Load(sessionID)
+	if !ok {
+		return
+	}
+
+	sess.mu.Lock()
+	delete(sess.addrs, srcAddr)
+	remaining := len(sess.addrs)
+	sess.mu.Unlock()
+
+	if remaining > 0 {
+		r.Logger.Debug("peer overlay timed out", slog.String("addr", srcAddr))
+		return
+	}
+	r.removeSession(sessionID, "timed out")
+}
+
+// Revoke revokes the auth key with the given label, and removes the peers that
+// authenticated with it, so their open connections are closed too.
+func (r *Receive) Revoke(label string) bool {
+	if !r.Keys.Revoke(label) {
+		return false
+	}
+	r.sessions.Range(func(sessionID string, sess *peerSession) bool {
+		if sess.keyLabel == label {
+			r.removeSession(sessionID, "removed, its auth key was revoked")
+		}
+		return true
+	})
+	return true
+}
+
+// removeSession removes a peer, along with its node from the netmap.
+func (r *Receive) removeSession(sessionID, reason string) {
+	sess, ok := r.sessions.LoadAndDelete(sessionID)
+	if !ok {
+		return
+	}
+
+	sess.mu.Lock()
+	addrs := sess.addrs
+	sess.addrs = nil
+	nodeKey := sess.nodeKey
+	nodeAddrs := sess.nodeAddrs
+	ipv4 := sess.ipv4
+	sess.mu.Unlock()
+
+	for addr := range addrs {
+		r.addrSession.Delete(addr)
+		r.seen.Delete(addr)
+		r.pending.Delete(addr)
+	}
+	// Keep rejecting replays of the peer's messages until they're stale
+	// anyway.
+	time.AfterFunc(maxMessageAge, func() {
+		r.replay.Delete(sessionID)
+		for addr := range addrs {
+			r.replay.Delete(addr)
+		}
+	})
+	for _, addr := range nodeAddrs {
+		r.releaseAddr(sessionID, addr.Addr())
+	}
+	if ipv4.IsValid() {
+		r.releaseAddr(sessionID, ipv4)
+	}
+
+	r.HumanLogf("%s Peer %s %s", cliui.Timestamp(time.Now()), cliui.Keyword(sess.hostInfo.String()), reason)
+	if !nodeKey.IsZero() {
+		r.removed <- nodeKey
+	}
+	if peer := r.oncePeer.Load(); peer != nil && *peer == sessionID {
+		r.onceLeftOnce.Do(func() { close(r.onceLeft) })
+	}
+}
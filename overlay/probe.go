@@ -0,0 +1,148 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/netmon"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// ProbeResult is the outcome of probing one of the overlays in an auth key.
+type ProbeResult struct {
+	// RelayLatency is how long it took to connect to the DERP relay. It is
+	// zero for STUN.
+	RelayLatency time.Duration
+	// ReceiverRTT is the round trip time of a ping to the receiver over the
+	// overlay.
+	ReceiverRTT time.Duration
+	// Addr is where the receiver was found. It is only set for LAN, as it
+	// isn't in the auth key.
+	Addr netip.AddrPort
+}
+
+// pingPacket returns a sealed ping to the receiver.
+func (ca *ClientAuth) pingPacket() []byte {
+	raw := new(messageSeq).marshal(overlayMessage{Typ: messageTypePing})
+	return ca.OverlayPrivateKey.SealTo(ca.ReceiverPublicKey, raw)
+}
+
+// isPong reports whether msg is a pong from the receiver.
+func (ca *ClientAuth) isPong(msg []byte) bool {
+	cleartext, ok := ca.OverlayPrivateKey.OpenFrom(ca.ReceiverPublicKey, msg)
+	if !ok {
+		return false
+	}
+	var ovMsg overlayMessage
+	if err := json.Unmarshal(cleartext, &ovMsg); err != nil {
+		return false
+	}
+	return ovMsg.Typ == messageTypePong
+}
+
+// ProbeDERP connects to the receiver's DERP region and pings the receiver
+// through it. If the relay is reachable but the receiver doesn't answer, the
+// result has a RelayLatency and an error is returned.
+func (ca *ClientAuth) ProbeDERP(ctx context.Context, dm *tailcfg.DERPMap) (ProbeResult, error) {
+	var res ProbeResult
+
+	region := dm.Regions[int(ca.ReceiverDERPRegionID)]
+	if region == nil {
+		return res, fmt.Errorf("DERP region %d is not in the DERP map", ca.ReceiverDERPRegionID)
+	}
+
+	derpPriv := key.NewNode()
+	c := derphttp.NewRegionClient(derpPriv, logger.Discard, netmon.NewStatic(), func() *tailcfg.DERPRegion {
+		return region
+	})
+	defer c.Close()
+
+	start := time.Now()
+	err := ca.admitDERP(ctx, dm, derpPriv.Public())
+	if err != nil {
+		return res, err
+	}
+	err = c.Connect(ctx)
+	if err != nil {
+		return res, fmt.Errorf("connect to DERP region %s: %w", region.RegionName, err)
+	}
+	res.RelayLatency = time.Since(start)
+
+	go func() {
+		<-ctx.Done()
+		_ = c.Close()
+	}()
+
+	start = time.Now()
+	err = c.Send(ca.ReceiverPublicKey, ca.pingPacket())
+	if err != nil {
+		return res, fmt.Errorf("send ping over DERP: %w", err)
+	}
+
+	for {
+		msg, err := c.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return res, errors.New("receiver did not answer over DERP")
+			}
+			return res, err
+		}
+
+		pkt, ok := msg.(derp.ReceivedPacket)
+		if !ok || pkt.Source != ca.ReceiverPublicKey || !ca.isPong(pkt.Data) {
+			continue
+		}
+		res.ReceiverRTT = time.Since(start)
+		return res, nil
+	}
+}
+
+// ProbeSTUN pings the receiver at its STUN address.
+func (ca *ClientAuth) ProbeSTUN(ctx context.Context) (ProbeResult, error) {
+	var res ProbeResult
+
+	conn, err := net.ListenUDP(udpNetwork(ca.ReceiverStunAddr), nil)
+	if err != nil {
+		return res, fmt.Errorf("listen UDP: %w", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	start := time.Now()
+	_, err = conn.WriteToUDPAddrPort(ca.pingPacket(), ca.ReceiverStunAddr)
+	if err != nil {
+		return res, fmt.Errorf("send ping over STUN: %w", err)
+	}
+
+	for {
+		buf := make([]byte, 4<<10)
+		n, addr, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return res, errors.New("receiver did not answer over STUN")
+			}
+			return res, err
+		}
+		if addr.Addr().Unmap() != ca.ReceiverStunAddr.Addr().Unmap() || !ca.isPong(buf[:n]) {
+			continue
+		}
+		res.ReceiverRTT = time.Since(start)
+		return res, nil
+	}
+}
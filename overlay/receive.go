@@ -5,32 +5,32 @@ package overlay
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"net"
+	mathrand "math/rand/v2"
 	"net/http"
 	"net/netip"
 	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/pion/stun/v3"
 	"github.com/pion/webrtc/v4"
 	"github.com/puzpuzpuz/xsync/v3"
 	"github.com/schollz/progressbar/v3"
-	"tailscale.com/derp"
-	"tailscale.com/derp/derphttp"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netmon"
 	"tailscale.com/net/portmapper"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 
-	"github.com/coder/pretty"
 	"github.com/coder/wush/cliui"
 )
 
@@ -40,10 +40,19 @@ func NewReceiveOverlay(logger *slog.Logger, hlog Logf, dm *tailcfg.DERPMap) *Rec
 		HumanLogf:   hlog,
 		DerpMap:     dm,
 		SelfPriv:    key.NewNode(),
-		PeerPriv:    key.NewNode(),
+		ControlPriv: key.NewMachine(),
+		Keys:        NewKeyRing(),
+		addrOwners:  xsync.NewMapOf[netip.Addr, string](),
+		pending:     xsync.NewMapOf[string, *pendingHello](),
+		sessions:    xsync.NewMapOf[string, *peerSession](),
+		addrSession: xsync.NewMapOf[string, string](),
+		replay:      xsync.NewMapOf[string, *replayWindow](),
+		seen:        xsync.NewMapOf[string, time.Time](),
 		webrtcConns: xsync.NewMapOf[key.NodePublic, *webrtc.PeerConnection](),
 		in:          make(chan *tailcfg.Node, 8),
+		removed:     make(chan key.NodePublic, 8),
 		out:         make(chan *overlayMessage, 8),
+		onceLeft:    make(chan struct{}),
 	}
 }
 
@@ -51,36 +60,137 @@ type Receive struct {
 	Logger    *slog.Logger
 	HumanLogf Logf
 	DerpMap   *tailcfg.DERPMap
+	// SelfHostedDERP embeds DerpMap in auth keys, for when it isn't
+	// Tailscale's public DERP map that clients use by default.
+	SelfHostedDERP bool
+	// DERPSecret is the shared secret the relays of DerpMap require, if any.
+	// It is embedded in auth keys along with DerpMap.
+	DERPSecret string
 	// SelfPriv is the private key that peers will encrypt overlay messages to.
 	// The public key of this is sent in the auth key.
 	SelfPriv key.NodePrivate
-	// PeerPriv is the main auth mechanism used to secure the overlay. Peers are
-	// sent this private key to encrypt node communication. Leaking this private
-	// key would allow anyone to connect.
-	PeerPriv key.NodePrivate
+	// ControlPriv is the key of the receiver's control server, which is
+	// persisted along with SelfPriv so that tsnet sees the same server after a
+	// restart.
+	ControlPriv key.MachinePrivate
+	// Keys are the main auth mechanism used to secure the overlay. Peers are
+	// sent one of these private keys to encrypt node communication. Leaking a
+	// private key would allow anyone to connect with its policy.
+	Keys *KeyRing
+	// addrOwners maps the tailnet addresses of peers to their session. IPv4
+	// addresses are assigned by us, and IPv6 ones belong to the first session
+	// whose node has them.
+	addrOwners *xsync.MapOf[netip.Addr, string]
+	// Once restricts the overlay to the first peer that is accepted.
+	// Messages from any other peer are rejected, even if they hold the auth
+	// key.
+	Once bool
+	// oncePeer is the session of the peer accepted in Once mode.
+	oncePeer atomic.Pointer[string]
+	// onceLeft is closed when the peer accepted in Once mode leaves.
+	onceLeft     chan struct{}
+	onceLeftOnce sync.Once
+	// Approve, if set, is called before a new peer is accepted. Peers that
+	// send an identity key must prove they hold it before Approve is called.
+	// It may block, e.g. to prompt the user.
+	Approve func(ConnectionRequest) bool
+	// OnReconnect, if set, is called when an overlay goes down, and when it
+	// comes back.
+	OnReconnect func(ReconnectEvent)
+	// STUNServers are the host:port of the STUN servers ListenOverlaySTUN
+	// asks for our address. Defaults to DefaultSTUNServers.
+	STUNServers []string
+	// STUNIPv6 makes ListenOverlaySTUN listen and find our address over
+	// IPv6 instead of IPv4.
+	STUNIPv6 bool
+	// DirectAddr is the address senders reach the direct overlay at.
+	DirectAddr netip.AddrPort
+	// OnSTUNAddrChange, if set, is called when our STUN address changes, once
+	// connected peers have been told. Auth keys minted before then have the
+	// old address.
+	OnSTUNAddrChange func(netip.AddrPort)
+	// pending holds Hellos waiting on an identity proof, keyed by overlay
+	// address.
+	pending *xsync.MapOf[string, *pendingHello]
+	// sessions are the senders that have sent a Hello, keyed by session ID.
+	sessions *xsync.MapOf[string, *peerSession]
+	// addrSession maps the overlay address of a sender to its session ID. A
+	// sender connected over both DERP and STUN has two addresses.
+	addrSession *xsync.MapOf[string, string]
+	// seq stamps the messages we send.
+	seq messageSeq
+	// replay holds the replay window of each sender, keyed by session ID.
+	replay *xsync.MapOf[string, *replayWindow]
+	// seen is when we last heard from each overlay address.
+	seen      *xsync.MapOf[string, time.Time]
+	evictOnce sync.Once
 
 	// stunIP is the STUN address that can be used for P2P overlay
-	// communication.
-	stunIP netip.AddrPort
+	// communication, or the configured address of the direct overlay. It is
+	// updated by the STUN overlay as its NAT mapping changes.
+	stunIP atomic.Pointer[netip.AddrPort]
 	// derpRegionID is the DERP region that can be used for proxied overlay
 	// communication.
 	derpRegionID uint16
+	// lan is whether senders can discover us on the local network.
+	lan bool
 
 	webrtcConns *xsync.MapOf[key.NodePublic, *webrtc.PeerConnection]
 
 	lastNode atomic.Pointer[tailcfg.Node]
 	// in funnels node updates from other peers to us
 	in chan *tailcfg.Node
+	// removed funnels the node keys of peers that have gone away
+	removed chan key.NodePublic
 	// out fans out our node updates to peers
 	out chan *overlayMessage
+	// subs are the overlays we're listening on. Messages sent to out are
+	// copied to each of them.
+	subsMu     sync.Mutex
+	subs       map[chan *overlayMessage]struct{}
+	fanOutOnce sync.Once
+}
+
+// IPs returns our tailnet addresses, which are the same for every receiver.
+func (r *Receive) IPs(context.Context) ([]netip.Addr, error) {
+	return r.selfIPs(), nil
 }
 
-func (r *Receive) IPs() []netip.Addr {
+func (r *Receive) selfIPs() []netip.Addr {
 	i6 := [16]byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0}
 	i6[15] = 0x01
 	return []netip.Addr{
-		// netip.AddrFrom4([4]byte{100, 64, 0, 0}),
 		netip.AddrFrom16(i6),
+		ReceiverIPv4,
+	}
+}
+
+// assignIPv4 gives the session a tailnet IPv4 address no other peer has, if it
+// doesn't have one yet. Addresses are picked at random, so that ones of peers
+// that just left aren't reused while they may still be in netmaps.
+func (r *Receive) assignIPv4(sessionID string, sess *peerSession) netip.Addr {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.ipv4.IsValid() {
+		return sess.ipv4
+	}
+
+	base := TailnetIPv4Prefix.Addr().As4()
+	hostBits := 32 - TailnetIPv4Prefix.Bits()
+	for {
+		host := mathrand.Uint32N(1 << hostBits)
+		ip := base
+		binary.BigEndian.PutUint32(ip[:], binary.BigEndian.Uint32(base[:])|host)
+		addr := netip.AddrFrom4(ip)
+		// Skip the network and broadcast addresses.
+		if host == 0 || host == 1<<hostBits-1 || addr == ReceiverIPv4 {
+			continue
+		}
+		if _, taken := r.addrOwners.LoadOrStore(addr, sessionID); taken {
+			continue
+		}
+		sess.ipv4 = addr
+		return addr
 	}
 }
 
@@ -152,244 +262,279 @@ func (r *Receive) PickDERPHome(ctx context.Context) error {
 	return nil
 }
 
-func (r *Receive) ClientAuth() *ClientAuth {
-	return &ClientAuth{
-		OverlayPrivateKey:    r.PeerPriv,
+// stunAddr returns the UDP address senders can reach us at, if any.
+func (r *Receive) stunAddr() netip.AddrPort {
+	if addr := r.stunIP.Load(); addr != nil {
+		return *addr
+	}
+	return netip.AddrPort{}
+}
+
+func (r *Receive) ClientAuth(pk *PeerKey) *ClientAuth {
+	ca := &ClientAuth{
+		OverlayPrivateKey:    pk.Priv,
 		ReceiverPublicKey:    r.SelfPriv.Public(),
-		ReceiverStunAddr:     r.stunIP,
+		ReceiverStunAddr:     r.stunAddr(),
 		ReceiverDERPRegionID: r.derpRegionID,
+		ReceiverLAN:          r.lan,
+		Policy:               pk.Policy,
+	}
+	if r.SelfHostedDERP {
+		ca.DERPMap = r.DerpMap
+		ca.DERPSecret = r.DERPSecret
 	}
+	return ca
 }
 
-func (r *Receive) Recv() <-chan *tailcfg.Node {
-	return r.in
+func (r *Receive) AdmitDERP(ctx context.Context, nodeKey key.NodePublic) error {
+	if r.DERPSecret == "" {
+		return nil
+	}
+	return AdmitDERPKeys(ctx, r.DerpMap, r.DERPSecret, nodeKey)
 }
 
-func (r *Receive) SendTailscaleNodeUpdate(node *tailcfg.Node) {
-	r.out <- &overlayMessage{
-		Typ:  messageTypeNodeUpdate,
-		Node: *node.Clone(),
+// Authorize returns an error if the peer with the given tailnet address may
+// not use scope, according to the policy of the key it authenticated with.
+func (r *Receive) Authorize(peer netip.Addr, scope Scope, port uint16) error {
+	sessionID, ok := r.addrOwners.Load(peer.Unmap())
+	if !ok {
+		return fmt.Errorf("unknown peer %s", peer)
+	}
+	sess, ok := r.sessions.Load(sessionID)
+	if !ok {
+		return fmt.Errorf("unknown peer %s", peer)
 	}
+	pk, ok := r.Keys.Get(sess.keyLabel)
+	if !ok {
+		return fmt.Errorf("auth key %q has been revoked", sess.keyLabel)
+	}
+	return pk.Authorize(scope, port)
 }
 
-// gonna have to do something special for per-peer webrtc connections
-
-func (r *Receive) ListenOverlaySTUN(ctx context.Context) (<-chan struct{}, error) {
-	srvAddr, err := net.ResolveUDPAddr("udp4", "stun.l.google.com:19302")
-	if err != nil {
-		return nil, fmt.Errorf("resolve google STUN: %w", err)
+// sealTo seals raw to the peer at srcAddr, which authenticated with the key
+// keyLabel. It returns false if the key has since been revoked.
+func (r *Receive) sealTo(srcAddr, keyLabel string, raw []byte) ([]byte, bool) {
+	pk, ok := r.Keys.Get(keyLabel)
+	if !ok {
+		return nil, false
 	}
+	return r.SelfPriv.SealTo(r.peerKey(srcAddr, pk), raw), true
+}
 
-	conn, err := net.ListenUDP("udp4", nil)
-	if err != nil {
-		return nil, fmt.Errorf("listen STUN: %w", err)
+// peerKey returns the key to seal messages to the sender at srcAddr to: its
+// session key if it has one, otherwise the auth key it used.
+func (r *Receive) peerKey(srcAddr string, pk *PeerKey) key.NodePublic {
+	if sess, ok := r.sessions.Load(r.sessionID(srcAddr)); ok {
+		return sess.peerKey(pk)
 	}
+	return pk.Priv.Public()
+}
 
-	go func() {
-		<-ctx.Done()
-		_ = conn.Close()
-	}()
-
-	m := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
-
-	restun := time.NewTicker(time.Nanosecond)
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case <-restun.C:
-				_, err = conn.WriteToUDP(m.Raw, srvAddr)
-				if err != nil {
-					r.HumanLogf("%s Failed to write STUN request on overlay: %s", cliui.Timestamp(time.Now()), err)
-				}
-				restun.Reset(30 * time.Second)
+// openFrom decrypts a message from the sender of sess, which may be nil for
+// first contact. It reports whether the message was sealed with the sender's
+// session key, rather than an auth key.
+func (r *Receive) openFrom(sess *peerSession, msg []byte) (pk *PeerKey, cleartext []byte, bySessionKey bool) {
+	if sess != nil && !sess.sessionKey.IsZero() {
+		if ct, ok := r.SelfPriv.OpenFrom(sess.sessionKey, msg); ok {
+			pk, ok := r.Keys.Get(sess.keyLabel)
+			if !ok {
+				return nil, nil, false
 			}
+			return pk, ct, true
 		}
-	}()
-
-	// node priv -> udp addr
-	peers := xsync.NewMapOf[key.NodePublic, netip.AddrPort]()
-
-	go func() {
-		for {
-
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-r.out:
-				if msg.Typ == messageTypeNodeUpdate {
-					r.lastNode.Store(&msg.Node)
-				}
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal overlay msg: " + err.Error())
-				}
+	}
 
-				sealed := r.SelfPriv.SealTo(r.PeerPriv.Public(), raw)
-				peers.Range(func(_ key.NodePublic, addr netip.AddrPort) bool {
-					_, err := conn.WriteToUDPAddrPort(sealed, addr)
-					if err != nil {
-						r.HumanLogf("%s Failed to send updated node over udp: %s", cliui.Timestamp(time.Now()), err)
-						return false
-					}
-					return true
-				})
-			}
+	for _, k := range r.Keys.Keys() {
+		if ct, ok := r.SelfPriv.OpenFrom(k.Priv.Public(), msg); ok {
+			return k, ct, false
 		}
-	}()
-
-	ipChan := make(chan struct{})
-
-	go func() {
-		var closeIPChanOnce sync.Once
-
-		for {
-			buf := make([]byte, 4<<10)
-			n, addr, err := conn.ReadFromUDPAddrPort(buf)
-			if err != nil {
-				r.Logger.Error("read from STUN; exiting", "err", err)
-				return
-			}
-
-			buf = buf[:n]
-			if stun.IsMessage(buf) {
-				m := new(stun.Message)
-				m.Raw = buf
+	}
+	return nil, nil, false
+}
 
-				if err := m.Decode(); err != nil {
-					r.Logger.Error("decode STUN message; exiting", "err", err)
-					return
-				}
+// replayWindow returns the replay window of the sender of msg. Senders that
+// predate sessions are tracked by overlay address, as are messages that claim
+// a session they weren't sealed with the session key of.
+func (r *Receive) replayWindow(msg overlayMessage, srcAddr string, bySessionKey bool) *replayWindow {
+	stream := msg.SessionID
+	if stream == "" {
+		stream = srcAddr
+	} else if sess, ok := r.sessions.Load(stream); ok && !sess.sessionKey.IsZero() && !bySessionKey {
+		stream = srcAddr
+	}
+	w, _ := r.replay.LoadOrCompute(stream, func() *replayWindow {
+		return &replayWindow{}
+	})
+	return w
+}
 
-				var xorAddr stun.XORMappedAddress
-				if err := xorAddr.GetFrom(m); err != nil {
-					r.Logger.Error("decode STUN xor mapped addr; exiting", "err", err)
-					return
-				}
+// pendingHello is a connection request waiting on an identity proof.
+type pendingHello struct {
+	hello     overlayMessage
+	sessionID string
+	challenge []byte
+}
 
-				stunAddr, ok := netip.AddrFromSlice(xorAddr.IP)
-				if !ok {
-					r.Logger.Error("convert STUN xor mapped addr", "ip", xorAddr.IP.String())
-					continue
-				}
-				stunAddrPort := netip.AddrPortFrom(stunAddr, uint16(xorAddr.Port))
+// peerSession is a single sender, which may be connected over several
+// overlays at once.
+type peerSession struct {
+	mu sync.Mutex
+	// identity is the identity key sent in the first Hello. Other overlays
+	// may only join the session by proving they hold it.
+	identity key.NodePublic
+	accepted bool
+	// approving is set while Approve is deciding. Responses to Hellos that
+	// arrive in the meantime are queued in waiting.
+	approving bool
+	waiting   []func(accepted bool)
+	// greeted is set once the first HelloResponse has been sent.
+	greeted bool
+
+	hostInfo HostInfo
+	// keepAlive is set if the sender pings over every overlay, so it can be
+	// removed once it stops.
+	keepAlive bool
+	// addrs are the overlay addresses the sender is connected over.
+	addrs map[string]struct{}
+	// nodeKey and nodeAddrs are from the sender's latest node.
+	nodeKey   key.NodePublic
+	nodeAddrs []netip.Prefix
+	// ipv4 is the tailnet IPv4 address we assigned to the sender.
+	ipv4 netip.Addr
+
+	// sessionKey is the sender's session key from its first Hello, if it
+	// supports them. keyLabel is the auth key it authenticated with.
+	sessionKey key.NodePublic
+	keyLabel   string
+}
 
-				// our first STUN response
-				if !r.stunIP.IsValid() {
-					r.HumanLogf("STUN address is %s", cliui.Code(stunAddrPort.String()))
-				}
+// peerKey returns the key to seal messages to the sender to.
+func (sess *peerSession) peerKey(pk *PeerKey) key.NodePublic {
+	if !sess.sessionKey.IsZero() {
+		return sess.sessionKey
+	}
+	return pk.Priv.Public()
+}
 
-				if r.stunIP.IsValid() && r.stunIP.Compare(stunAddrPort) != 0 {
-					r.HumanLogf(pretty.Sprintf(cliui.DefaultStyles.Warn, "STUN address changed, this may cause issues; %s->%s", r.stunIP.String(), stunAddrPort.String()))
-				}
-				r.stunIP = stunAddrPort
-				closeIPChanOnce.Do(func() {
-					close(ipChan)
-				})
-				continue
-			}
+// sessionID returns the session the sender at the overlay address belongs to.
+// Senders that don't send a session ID are identified by their address.
+func (r *Receive) sessionID(srcAddr string) string {
+	if id, ok := r.addrSession.Load(srcAddr); ok {
+		return id
+	}
+	if ph, ok := r.pending.Load(srcAddr); ok {
+		return ph.sessionID
+	}
+	return srcAddr
+}
 
-			res, key, err := r.handleNextMessage(key.NodePublic{}, buf, "STUN")
-			if err != nil {
-				r.HumanLogf("Failed to handle overlay message: %s", err.Error())
-				continue
-			}
+// peerAccepted returns whether the peer at the overlay address may exchange
+// nodes with us.
+func (r *Receive) peerAccepted(srcAddr string) bool {
+	if r.Approve == nil {
+		return true
+	}
+	sess, ok := r.sessions.Load(r.sessionID(srcAddr))
+	if !ok {
+		return false
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.accepted
+}
 
-			peers.Store(key, addr)
+func (r *Receive) Recv() <-chan *tailcfg.Node {
+	return r.in
+}
 
-			if res != nil {
-				_, err = conn.WriteToUDPAddrPort(res, addr)
-				if err != nil {
-					r.HumanLogf("Failed to send overlay response over STUN: %s", err.Error())
-					return
-				}
-			}
-		}
-	}()
-	return ipChan, nil
+func (r *Receive) SendTailscaleNodeUpdate(node *tailcfg.Node) {
+	r.out <- &overlayMessage{
+		Typ:  messageTypeNodeUpdate,
+		Node: *node.Clone(),
+	}
 }
 
-func (r *Receive) ListenOverlayDERP(ctx context.Context) error {
-	c := derphttp.NewRegionClient(r.SelfPriv, func(format string, args ...any) {}, netmon.NewStatic(), func() *tailcfg.DERPRegion {
-		return r.DerpMap.Regions[int(r.derpRegionID)]
+// subscribe returns a channel of the messages to fan out to peers over a
+// single overlay. It is unsubscribed when ctx is done.
+func (r *Receive) subscribe(ctx context.Context) <-chan *overlayMessage {
+	r.fanOutOnce.Do(func() {
+		go r.fanOut()
 	})
 
-	err := c.Connect(ctx)
-	if err != nil {
-		return err
+	ch := make(chan *overlayMessage, 8)
+	r.subsMu.Lock()
+	if r.subs == nil {
+		r.subs = map[chan *overlayMessage]struct{}{}
 	}
-
-	// node priv -> derp priv
-	peers := xsync.NewMapOf[key.NodePublic, key.NodePublic]()
+	r.subs[ch] = struct{}{}
+	r.subsMu.Unlock()
 
 	go func() {
-		for {
-
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-r.out:
-				if msg.Typ == messageTypeNodeUpdate {
-					r.lastNode.Store(&msg.Node)
-				}
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal overlay msg: " + err.Error())
-				}
-
-				sealed := r.SelfPriv.SealTo(r.PeerPriv.Public(), raw)
-				peers.Range(func(_, derpKey key.NodePublic) bool {
-					err = c.Send(derpKey, sealed)
-					if err != nil {
-						r.HumanLogf("Send updated node over DERP: %s", err)
-						return false
-					}
-					return true
-				})
-			}
-		}
+		<-ctx.Done()
+		r.subsMu.Lock()
+		delete(r.subs, ch)
+		r.subsMu.Unlock()
 	}()
+	return ch
+}
 
-	for {
-		msg, err := c.Recv()
-		if err != nil {
-			return err
+func (r *Receive) fanOut() {
+	for msg := range r.out {
+		if msg.Typ == messageTypeNodeUpdate {
+			r.lastNode.Store(&msg.Node)
 		}
 
-		switch msg := msg.(type) {
-		case derp.ReceivedPacket:
-			res, key, err := r.handleNextMessage(msg.Source, msg.Data, "DERP")
-			if err != nil {
-				r.HumanLogf("Failed to handle overlay message from %s: %s", msg.Source.ShortString(), err.Error())
-				continue
-			}
-
-			peers.Store(key, msg.Source)
-
-			if res != nil {
-				err = c.Send(msg.Source, res)
-				if err != nil {
-					r.HumanLogf("Failed to send overlay response over derp: %s", err.Error())
-					return err
-				}
+		r.subsMu.Lock()
+		for ch := range r.subs {
+			select {
+			case ch <- msg:
+			default:
+				r.Logger.Warn("overlay is not keeping up; dropped message", slog.Int("type", int(msg.Typ)))
 			}
 		}
+		r.subsMu.Unlock()
 	}
 }
 
-func (r *Receive) handleNextMessage(src key.NodePublic, msg []byte, system string) (resRaw []byte, nodeKey key.NodePublic, _ error) {
-	cleartext, ok := r.SelfPriv.OpenFrom(r.PeerPriv.Public(), msg)
-	if !ok {
-		return nil, key.NodePublic{}, errors.New("message failed decryption")
+// handleNextMessage handles a single overlay message, returning the sealed
+// response, if any. reply is used to respond later to Hellos that are waiting
+// on approval.
+func (r *Receive) handleNextMessage(src key.NodePublic, srcAddr string, msg []byte, system string, reply func([]byte) error) (resRaw []byte, keyLabel string, _ error) {
+	sess, _ := r.sessions.Load(r.sessionID(srcAddr))
+	pk, cleartext, bySessionKey := r.openFrom(sess, msg)
+	if pk == nil {
+		return nil, "", errors.New("message failed decryption")
 	}
 
-	var ovMsg overlayMessage
-	err := json.Unmarshal(cleartext, &ovMsg)
+	ovMsg, err := decodeOverlayMessage(cleartext)
 	if err != nil {
-		panic("unmarshal node: " + err.Error())
+		return nil, "", err
+	}
+	// Anyone with the auth key can seal messages with it, so once a sender
+	// has a session key only its Hellos may use the auth key.
+	if sess != nil && !sess.sessionKey.IsZero() && !bySessionKey && ovMsg.Typ != messageTypeHello {
+		return nil, "", errors.New("rejected message; it wasn't sealed with the peer's session key")
+	}
+	err = r.replayWindow(ovMsg, srcAddr, bySessionKey).check(ovMsg, time.Now())
+	if err != nil {
+		return nil, "", err
+	}
+	r.seen.Store(srcAddr, time.Now())
+
+	if r.Once {
+		sessionID := r.sessionID(srcAddr)
+		if ovMsg.Typ == messageTypeHello && ovMsg.SessionID != "" {
+			sessionID = ovMsg.SessionID
+		}
+		// The peer is only claimed once it's accepted, so that peers rejected
+		// before then don't lock out everyone else.
+		peer := r.oncePeer.Load()
+		switch {
+		case peer != nil && *peer != sessionID:
+			return nil, "", errors.New("rejected message; auth key has already been used by another peer")
+		case peer == nil && ovMsg.Typ != messageTypeHello && ovMsg.Typ != messageTypeIdentityProof:
+			return nil, "", errors.New("rejected message; peer has not been accepted")
+		}
 	}
 
 	res := overlayMessage{}
@@ -399,26 +544,40 @@ func (r *Receive) handleNextMessage(src key.NodePublic, msg []byte, system strin
 	case messageTypePong:
 		// do nothing
 	case messageTypeHello:
-		res.Typ = messageTypeHelloResponse
-		username := "unknown"
-		if u := ovMsg.HostInfo.Username; u != "" {
-			username = u
+		if pk.Expired() {
+			return nil, "", fmt.Errorf("rejected connection request; auth key %q expired", pk.Label)
 		}
-		hostname := "unknown"
-		if h := ovMsg.HostInfo.Hostname; h != "" {
-			hostname = h
+		if err := checkProtocol(ovMsg); err != nil {
+			r.reply(pk.Priv.Public(), overlayMessage{Typ: messageTypeHelloIncompatible}.withProtocol(cliFeatures), system, reply)
+			return nil, "", fmt.Errorf("rejected connection request from %s: %w", ovMsg.HostInfo, err)
 		}
-		if lastNode := r.lastNode.Load(); lastNode != nil {
-			res.Node = *lastNode
+		err := r.handleHello(src, srcAddr, pk, ovMsg, system, reply)
+		if err != nil {
+			return nil, "", err
 		}
-
-		if ovMsg.WebrtcDescription != nil {
-			r.setupWebrtcConnection(src, &res, *ovMsg.WebrtcDescription)
+	case messageTypeIdentityProof:
+		ph, ok := r.pending.LoadAndDelete(srcAddr)
+		if !ok {
+			break
 		}
-
-		r.HumanLogf("%s Received connection request over %s from %s", cliui.Timestamp(time.Now()), system, cliui.Keyword(fmt.Sprintf("%s@%s", username, hostname)))
+		proof, ok := r.SelfPriv.OpenFrom(ph.hello.Identity, ovMsg.IdentityProof)
+		if !ok || !hmac.Equal(proof, ph.challenge) {
+			return nil, "", errors.New("rejected connection request; peer failed to prove its identity")
+		}
+		sess, ok := r.sessions.Load(ph.sessionID)
+		if !ok {
+			break
+		}
+		r.admit(src, srcAddr, ph.sessionID, sess, pk, ph.hello, system, reply)
 	case messageTypeNodeUpdate:
+		if !r.peerAccepted(srcAddr) {
+			return nil, "", errors.New("rejected node update; peer has not been approved")
+		}
 		r.Logger.Debug("received updated node", slog.String("node_key", ovMsg.Node.Key.String()))
+		err := r.updateSessionNode(srcAddr, &ovMsg.Node)
+		if err != nil {
+			return nil, "", fmt.Errorf("rejected node update: %w", err)
+		}
 		r.in <- &ovMsg.Node
 		res.Typ = messageTypeNodeUpdate
 		if lastNode := r.lastNode.Load(); lastNode != nil {
@@ -426,6 +585,12 @@ func (r *Receive) handleNextMessage(src key.NodePublic, msg []byte, system strin
 		}
 
 	case messageTypeWebRTCCandidate:
+		if !r.peerAccepted(srcAddr) {
+			return nil, "", errors.New("rejected candidate; peer has not been approved")
+		}
+		if ovMsg.WebrtcCandidate == nil {
+			return nil, "", errors.New("webrtc candidate message is missing the candidate")
+		}
 		pc, ok := r.webrtcConns.Load(src)
 		if !ok {
 			fmt.Println("got candidate for unknown connection")
@@ -436,19 +601,284 @@ func (r *Receive) handleNextMessage(src key.NodePublic, msg []byte, system strin
 		if err != nil {
 			fmt.Println("failed to add ice candidate:", err)
 		}
+
+	case messageTypeGoodbye:
+		r.removeSession(r.sessionID(srcAddr), "disconnected")
+
+	default:
+		// Likely from a newer peer, which must not rely on us understanding it.
+		r.Logger.Debug("ignoring unsupported overlay message", slog.String("type", ovMsg.Typ.String()))
 	}
 
 	if res.Typ == 0 {
-		return nil, ovMsg.Node.Key, nil
+		return nil, pk.Label, nil
+	}
+
+	sealed := r.SelfPriv.SealTo(r.peerKey(srcAddr, pk), r.seq.marshal(res))
+	return sealed, pk.Label, nil
+}
+
+// handleHello starts or joins the sender's session. Responses are sent with
+// reply, as they may have to wait for approval.
+func (r *Receive) handleHello(src key.NodePublic, srcAddr string, pk *PeerKey, hello overlayMessage, system string, reply func([]byte) error) error {
+	sessionID := hello.SessionID
+	if sessionID == "" {
+		sessionID = srcAddr
+	}
+
+	sess, existed := r.sessions.LoadOrCompute(sessionID, func() *peerSession {
+		sess := &peerSession{
+			identity:  hello.Identity,
+			hostInfo:  hello.HostInfo,
+			keepAlive: slices.Contains(hello.Features, featureKeepAlive),
+			addrs:     map[string]struct{}{},
+			keyLabel:  pk.Label,
+		}
+		if slices.Contains(hello.Features, featureSessionKeys) {
+			sess.sessionKey = hello.SessionKey
+		}
+		return sess
+	})
+	joinedID, joined := r.addrSession.Load(srcAddr)
+	joined = joined && joinedID == sessionID
+	if existed && !joined {
+		// Another overlay of a known sender. Only the holder of the session's
+		// identity key may join it.
+		if hello.Identity.IsZero() || hello.Identity != sess.identity {
+			return errors.New("rejected connection request; session belongs to another peer")
+		}
+	}
+
+	if !hello.Identity.IsZero() && !joined && (r.Approve != nil || existed) {
+		challenge := make([]byte, 32)
+		if _, err := rand.Read(challenge); err != nil {
+			return fmt.Errorf("read random: %w", err)
+		}
+		r.pending.Store(srcAddr, &pendingHello{
+			hello:     hello,
+			sessionID: sessionID,
+			challenge: challenge,
+		})
+		r.reply(sess.peerKey(pk), overlayMessage{Typ: messageTypeIdentityChallenge, Challenge: challenge}, system, reply)
+		return nil
+	}
+
+	r.admit(src, srcAddr, sessionID, sess, pk, hello, system, reply)
+	return nil
+}
+
+// admit adds the overlay address to the session and responds to its Hello
+// once the session has been accepted.
+func (r *Receive) admit(src key.NodePublic, srcAddr, sessionID string, sess *peerSession, pk *PeerKey, hello overlayMessage, system string, reply func([]byte) error) {
+	r.addrSession.Store(srcAddr, sessionID)
+	sess.mu.Lock()
+	if sess.addrs != nil {
+		sess.addrs[srcAddr] = struct{}{}
+	}
+	sess.mu.Unlock()
+
+	respond := func(accepted bool) {
+		if !accepted {
+			r.reply(sess.peerKey(pk), overlayMessage{Typ: messageTypeHelloDenied}, system, reply)
+			return
+		}
+		r.reply(sess.peerKey(pk), r.helloResponse(src, sessionID, sess, pk, hello, system), system, reply)
 	}
 
-	raw, err := json.Marshal(res)
+	sess.mu.Lock()
+	switch {
+	case sess.accepted:
+		sess.mu.Unlock()
+		respond(true)
+	case sess.approving:
+		sess.waiting = append(sess.waiting, respond)
+		sess.mu.Unlock()
+	case r.Approve == nil:
+		sess.accepted = r.claimOnce(sessionID)
+		accepted := sess.accepted
+		sess.mu.Unlock()
+		respond(accepted)
+	default:
+		sess.approving = true
+		sess.waiting = append(sess.waiting, respond)
+		sess.mu.Unlock()
+
+		go func() {
+			// Don't prompt for peers that can't be accepted anyway.
+			accepted := false
+			if peer := r.oncePeer.Load(); peer == nil || *peer == sessionID {
+				accepted = r.Approve(ConnectionRequest{
+					HostInfo: hello.HostInfo,
+					Identity: sess.identity,
+					KeyLabel: pk.Label,
+				})
+				accepted = accepted && r.claimOnce(sessionID)
+			}
+			if !accepted {
+				r.HumanLogf("%s Denied connection request from %s", cliui.Timestamp(time.Now()), cliui.Keyword(hello.HostInfo.String()))
+			}
+
+			sess.mu.Lock()
+			sess.accepted = accepted
+			sess.approving = false
+			waiting := sess.waiting
+			sess.waiting = nil
+			sess.mu.Unlock()
+
+			for _, respond := range waiting {
+				respond(accepted)
+			}
+		}()
+	}
+}
+
+// claimOnce reports whether the session may be accepted. In Once mode, this
+// claims the overlay for the session if no other peer has been accepted yet.
+func (r *Receive) claimOnce(sessionID string) bool {
+	if !r.Once || r.oncePeer.CompareAndSwap(nil, &sessionID) {
+		return true
+	}
+	return *r.oncePeer.Load() == sessionID
+}
+
+// OnceLeft is closed when the peer accepted in Once mode leaves, whether or
+// not it opened any sessions.
+func (r *Receive) OnceLeft() <-chan struct{} {
+	return r.onceLeft
+}
+
+// updateSessionNode records the node of the sender at srcAddr, so it can be
+// removed from the netmap once the sender is gone, and names it after the
+// sender's host. If the sender's node key changed, the old node is removed now.
+// Nodes with addresses of another peer or of ours are rejected.
+func (r *Receive) updateSessionNode(srcAddr string, node *tailcfg.Node) error {
+	sessionID := r.sessionID(srcAddr)
+	sess, ok := r.sessions.Load(sessionID)
+	if !ok {
+		return errors.New("peer has no session")
+	}
+	nameNode(node, sess.hostInfo)
+
+	sess.mu.Lock()
+	// Removed sessions have no overlay addresses, and must not claim tailnet
+	// addresses that will never be released.
+	if sess.addrs == nil {
+		sess.mu.Unlock()
+		return errors.New("peer has left")
+	}
+	// Senders can't pick their own IPv4 address, which could be another
+	// peer's.
+	addrs := onlyIPv4(node.Addresses, sess.ipv4)
+	err := r.claimAddrs(sessionID, addrs)
 	if err != nil {
-		panic("marshal node: " + err.Error())
+		sess.mu.Unlock()
+		return err
+	}
+	for _, addr := range sess.nodeAddrs {
+		if !slices.Contains(addrs, addr) && addr.Addr() != sess.ipv4 {
+			r.releaseAddr(sessionID, addr.Addr())
+		}
 	}
+	node.Addresses = addrs
+	// Senders don't route anything but their own addresses.
+	node.AllowedIPs = slices.Clone(addrs)
 
-	sealed := r.SelfPriv.SealTo(r.PeerPriv.Public(), raw)
-	return sealed, ovMsg.Node.Key, nil
+	old := sess.nodeKey
+	sess.nodeKey = node.Key
+	sess.nodeAddrs = node.Addresses
+	sess.mu.Unlock()
+
+	if !old.IsZero() && old != node.Key {
+		r.removed <- old
+	}
+	return nil
+}
+
+// claimAddrs makes sessionID the owner of the tailnet addresses in prefixes.
+// Nothing is claimed if any of them isn't a single address, or belongs to us
+// or another session.
+func (r *Receive) claimAddrs(sessionID string, prefixes []netip.Prefix) error {
+	claimed := []netip.Addr{}
+	for _, p := range prefixes {
+		addr := p.Addr().Unmap()
+		var err error
+		switch {
+		case !p.IsSingleIP():
+			err = fmt.Errorf("address %s isn't a single IP", p)
+		case slices.Contains(r.selfIPs(), addr):
+			err = fmt.Errorf("address %s belongs to the receiver", addr)
+		default:
+			owner, loaded := r.addrOwners.LoadOrStore(addr, sessionID)
+			if owner != sessionID {
+				err = fmt.Errorf("address %s belongs to another peer", addr)
+			} else if !loaded {
+				claimed = append(claimed, addr)
+			}
+		}
+		if err != nil {
+			for _, addr := range claimed {
+				r.releaseAddr(sessionID, addr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAddr gives up the tailnet address, if sessionID owns it.
+func (r *Receive) releaseAddr(sessionID string, addr netip.Addr) {
+	r.addrOwners.Compute(addr, func(owner string, loaded bool) (string, bool) {
+		return owner, owner == sessionID
+	})
+}
+
+// onlyIPv4 returns prefixes without IPv4 addresses other than ipv4.
+func onlyIPv4(prefixes []netip.Prefix, ipv4 netip.Addr) []netip.Prefix {
+	return slices.DeleteFunc(slices.Clone(prefixes), func(p netip.Prefix) bool {
+		return p.Addr().Unmap().Is4() && p != netip.PrefixFrom(ipv4, 32)
+	})
+}
+
+// helloResponse accepts the peer's Hello. WebRTC is only set up for the
+// first overlay of a session.
+func (r *Receive) helloResponse(src key.NodePublic, sessionID string, sess *peerSession, pk *PeerKey, hello overlayMessage, system string) overlayMessage {
+	ipv4 := r.assignIPv4(sessionID, sess)
+	res := overlayMessage{
+		Typ:      messageTypeHelloResponse,
+		HostInfo: localHostInfo(),
+		IPv4:     &ipv4,
+	}.withProtocol(cliFeatures)
+	if lastNode := r.lastNode.Load(); lastNode != nil {
+		res.Node = *lastNode
+	}
+
+	sess.mu.Lock()
+	greeted := sess.greeted
+	sess.greeted = true
+	sess.mu.Unlock()
+	if greeted {
+		r.Logger.Debug("peer connected over another overlay", slog.String("system", system))
+		return res
+	}
+
+	r.Logger.Debug("peer protocol",
+		slog.Int("version", hello.ProtocolVersion),
+		slog.Any("features", negotiateFeatures(cliFeatures, hello.Features)),
+	)
+	if hello.WebrtcDescription != nil {
+		r.setupWebrtcConnection(src, &res, *hello.WebrtcDescription)
+	}
+
+	r.HumanLogf("%s Received connection request over %s from %s with key %s", cliui.Timestamp(time.Now()), system, cliui.Keyword(hello.HostInfo.String()), cliui.Code(pk.Label))
+	return res
+}
+
+// reply seals msg to the peer's key and sends it with send.
+func (r *Receive) reply(to key.NodePublic, msg overlayMessage, system string, send func([]byte) error) {
+	err := send(r.SelfPriv.SealTo(to, r.seq.marshal(msg)))
+	if err != nil {
+		r.HumanLogf("Failed to send overlay response over %s: %s", system, err.Error())
+	}
 }
 
 func (r *Receive) setupWebrtcConnection(src key.NodePublic, res *overlayMessage, offer webrtc.SessionDescription) {
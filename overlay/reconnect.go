@@ -0,0 +1,79 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// ReconnectEvent reports an overlay losing its connection, or getting it back.
+type ReconnectEvent struct {
+	// Overlay is the overlay the event is for, i.e. "DERP" or "STUN".
+	Overlay string
+	// Err is why the overlay is down. It is nil once it has reconnected.
+	Err error
+	// Attempt counts the failed attempts since the overlay went down.
+	Attempt int
+	// RetryIn is how long until the next attempt, if Err is set.
+	RetryIn time.Duration
+}
+
+// reconnectLoop runs connect until ctx is done or connect fails with a fatal
+// error, backing off exponentially between attempts. connect calls connected
+// once the overlay works, which resets the backoff. Events are reported to
+// onEvent, if set.
+func reconnectLoop(ctx context.Context, name string, onEvent func(ReconnectEvent), connect func(ctx context.Context, connected func()) error) error {
+	report := func(ev ReconnectEvent) {
+		if onEvent != nil {
+			onEvent(ev)
+		}
+	}
+
+	attempt := 0
+	for {
+		err := connect(ctx, func() {
+			if attempt > 0 {
+				report(ReconnectEvent{Overlay: name, Attempt: attempt})
+				attempt = 0
+			}
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isFatal(err) {
+			return err
+		}
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+
+		attempt++
+		delay := reconnectDelay(attempt)
+		report(ReconnectEvent{Overlay: name, Err: err, Attempt: attempt, RetryIn: delay})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// reconnectDelay doubles the delay for each attempt up to maxReconnectDelay,
+// with jitter so peers of a restarted relay don't all come back at once.
+func reconnectDelay(attempt int) time.Duration {
+	d := maxReconnectDelay
+	if attempt < 6 {
+		d = min(minReconnectDelay<<(attempt-1), maxReconnectDelay)
+	}
+	return d/2 + rand.N(d/2)
+}
@@ -0,0 +1,83 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// RelayAdmitPath is where `wush relay` admits DERP keys when it requires a
+// shared secret. Clients post a RelayAdmitRequest to it with the secret as a
+// bearer token, before connecting to the relay with those keys.
+const RelayAdmitPath = "/wush/admit"
+
+// RelayAdmitRequest is the body of requests to RelayAdmitPath.
+type RelayAdmitRequest struct {
+	Keys []key.NodePublic `json:"keys"`
+}
+
+// AdmitDERPKeys asks the relay of every region in dm to let keys connect,
+// proving we know its shared secret. Relays without a secret accept any key,
+// so this is only needed for relays that require one.
+func AdmitDERPKeys(ctx context.Context, dm *tailcfg.DERPMap, secret string, keys ...key.NodePublic) error {
+	body, err := json.Marshal(RelayAdmitRequest{Keys: keys})
+	if err != nil {
+		panic("marshal relay admit request: " + err.Error())
+	}
+
+	for _, id := range dm.RegionIDs() {
+		for _, node := range dm.Regions[id].Nodes {
+			if node.STUNOnly {
+				continue
+			}
+			err := admitDERPKeys(ctx, node, secret, body)
+			if err != nil {
+				return fmt.Errorf("admit keys to DERP relay %s: %w", node.HostName, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func admitDERPKeys(ctx context.Context, node *tailcfg.DERPNode, secret string, body []byte) error {
+	u := url.URL{Scheme: "https", Host: node.HostName, Path: RelayAdmitPath}
+	if node.DERPPort != 0 {
+		u.Host = net.JoinHostPort(node.HostName, strconv.Itoa(node.DERPPort))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+secret)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// admitDERP admits k to the relays of dm, if the receiver's relays require a
+// shared secret.
+func (ca *ClientAuth) admitDERP(ctx context.Context, dm *tailcfg.DERPMap, k key.NodePublic) error {
+	if ca.DERPSecret == "" {
+		return nil
+	}
+	return AdmitDERPKeys(ctx, dm, ca.DERPSecret, k)
+}
@@ -0,0 +1,119 @@
+package overlay
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMessageAge is how far a sealed overlay message's timestamp may be from
+// the current time before it is rejected as stale. This also bounds how far
+// apart the clocks of two peers can be.
+const maxMessageAge = 5 * time.Minute
+
+// errReplayed is returned for messages that were already handled, or that are
+// too old to tell.
+var errReplayed = errors.New("rejected replayed or stale overlay message")
+
+// errUnstamped is returned for messages without a sequence number from peers
+// that don't predate replay protection.
+var errUnstamped = errors.New("rejected overlay message without a sequence number")
+
+// messageSeq stamps outgoing overlay messages with a sequence number and the
+// time they were sealed, so peers can reject replays.
+type messageSeq struct {
+	seq  atomic.Uint64
+	once sync.Once
+}
+
+// marshal stamps msg and returns it encoded.
+func (ms *messageSeq) marshal(msg overlayMessage) []byte {
+	ms.once.Do(func() {
+		// Start from the clock, so sequence numbers keep increasing across
+		// restarts and peers that remember our old ones still accept us.
+		ms.seq.Store(uint64(time.Now().UnixNano()))
+	})
+	msg.Seq = ms.seq.Add(1)
+	msg.Timestamp = time.Now().UnixMilli()
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		panic("marshal overlay msg: " + err.Error())
+	}
+	return raw
+}
+
+// replayWindowSize is how many sequence numbers behind the highest one seen
+// are still accepted, as messages sent over different overlays can arrive out
+// of order.
+const replayWindowSize = 64
+
+// replayWindow tracks the sequence numbers seen from a single peer.
+type replayWindow struct {
+	mu      sync.Mutex
+	highest uint64
+	// seen has bit i set if highest-i has been accepted.
+	seen uint64
+	// legacy is set once the peer has greeted us as one that predates
+	// replay protection, which never stamps its messages.
+	legacy bool
+}
+
+// check returns errReplayed if msg is stale or was already accepted.
+// Messages without a sequence number are only accepted from legacy peers, and
+// return errUnstamped otherwise.
+func (w *replayWindow) check(msg overlayMessage, now time.Time) error {
+	if msg.Seq == 0 {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if isLegacyGreeting(msg) {
+			w.legacy = true
+		}
+		if !w.legacy {
+			return errUnstamped
+		}
+		return nil
+	}
+	age := now.Sub(time.UnixMilli(msg.Timestamp))
+	if age > maxMessageAge || age < -maxMessageAge {
+		return errReplayed
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case msg.Seq > w.highest:
+		shift := msg.Seq - w.highest
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = msg.Seq
+		return nil
+	case w.highest-msg.Seq >= replayWindowSize:
+		return errReplayed
+	default:
+		bit := uint64(1) << (w.highest - msg.Seq)
+		if w.seen&bit != 0 {
+			return errReplayed
+		}
+		w.seen |= bit
+		return nil
+	}
+}
+
+// isLegacyGreeting reports whether msg is a Hello or Hello response from a peer
+// that predates replay protection. Such peers don't speak a protocol version
+// or support sessions.
+func isLegacyGreeting(msg overlayMessage) bool {
+	if msg.Typ != messageTypeHello && msg.Typ != messageTypeHelloResponse {
+		return false
+	}
+	return msg.ProtocolVersion == 0 && !slices.Contains(msg.Features, featureSessions)
+}
@@ -0,0 +1,109 @@
+package overlay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReplayWindowCheck(t *testing.T) {
+	now := time.Now()
+	msg := func(seq uint64) overlayMessage {
+		return overlayMessage{Seq: seq, Timestamp: now.UnixMilli()}
+	}
+
+	t.Run("Duplicate", func(t *testing.T) {
+		w := &replayWindow{}
+		if err := w.check(msg(100), now); err != nil {
+			t.Fatalf("first message rejected: %v", err)
+		}
+		if err := w.check(msg(100), now); !errors.Is(err, errReplayed) {
+			t.Fatalf("duplicate accepted, got %v", err)
+		}
+	})
+
+	t.Run("OutOfOrder", func(t *testing.T) {
+		w := &replayWindow{}
+		for _, seq := range []uint64{100, 98, 99, 97} {
+			if err := w.check(msg(seq), now); err != nil {
+				t.Fatalf("seq %d rejected: %v", seq, err)
+			}
+		}
+		if err := w.check(msg(98), now); !errors.Is(err, errReplayed) {
+			t.Fatalf("duplicate of out of order message accepted, got %v", err)
+		}
+	})
+
+	t.Run("OutOfWindow", func(t *testing.T) {
+		w := &replayWindow{}
+		if err := w.check(msg(1000), now); err != nil {
+			t.Fatalf("first message rejected: %v", err)
+		}
+		if err := w.check(msg(1000-replayWindowSize+1), now); err != nil {
+			t.Fatalf("oldest message in window rejected: %v", err)
+		}
+		if err := w.check(msg(1000-replayWindowSize), now); !errors.Is(err, errReplayed) {
+			t.Fatalf("message behind window accepted, got %v", err)
+		}
+	})
+
+	t.Run("WindowSlides", func(t *testing.T) {
+		w := &replayWindow{}
+		if err := w.check(msg(10), now); err != nil {
+			t.Fatalf("first message rejected: %v", err)
+		}
+		// Jumping past the window forgets what was seen, but what fell out
+		// of it is still rejected.
+		if err := w.check(msg(10+replayWindowSize), now); err != nil {
+			t.Fatalf("message after jump rejected: %v", err)
+		}
+		if err := w.check(msg(10), now); !errors.Is(err, errReplayed) {
+			t.Fatalf("message behind slid window accepted, got %v", err)
+		}
+		if err := w.check(msg(11), now); err != nil {
+			t.Fatalf("unseen message in slid window rejected: %v", err)
+		}
+	})
+
+	t.Run("NoSeq", func(t *testing.T) {
+		w := &replayWindow{}
+		if err := w.check(overlayMessage{Typ: messageTypePing}, now); !errors.Is(err, errUnstamped) {
+			t.Fatalf("message without seq accepted before a legacy Hello, got %v", err)
+		}
+		hello := overlayMessage{Typ: messageTypeHello, ProtocolVersion: protocolVersion}
+		if err := w.check(hello, now); !errors.Is(err, errUnstamped) {
+			t.Fatalf("versioned Hello without seq accepted, got %v", err)
+		}
+		hello = overlayMessage{Typ: messageTypeHello, Features: []string{featureSessions}}
+		if err := w.check(hello, now); !errors.Is(err, errUnstamped) {
+			t.Fatalf("Hello with sessions without seq accepted, got %v", err)
+		}
+
+		// Peers that predate replay protection don't number their messages,
+		// and don't have timestamps either.
+		if err := w.check(overlayMessage{Typ: messageTypeHello}, now); err != nil {
+			t.Fatalf("legacy Hello rejected: %v", err)
+		}
+		for range 2 {
+			if err := w.check(overlayMessage{Typ: messageTypePing}, now); err != nil {
+				t.Fatalf("message without seq from legacy peer rejected: %v", err)
+			}
+		}
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		w := &replayWindow{}
+		old := overlayMessage{Seq: 1, Timestamp: now.Add(-maxMessageAge - time.Second).UnixMilli()}
+		if err := w.check(old, now); !errors.Is(err, errReplayed) {
+			t.Fatalf("stale message accepted, got %v", err)
+		}
+		future := overlayMessage{Seq: 2, Timestamp: now.Add(maxMessageAge + time.Second).UnixMilli()}
+		if err := w.check(future, now); !errors.Is(err, errReplayed) {
+			t.Fatalf("message from the future accepted, got %v", err)
+		}
+		recent := overlayMessage{Seq: 3, Timestamp: now.Add(-maxMessageAge + time.Second).UnixMilli()}
+		if err := w.check(recent, now); err != nil {
+			t.Fatalf("message within max age rejected: %v", err)
+		}
+	})
+}
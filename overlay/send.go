@@ -9,31 +9,41 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/netip"
 	"os"
 	"os/user"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/wush/cliui"
+	"github.com/google/uuid"
 	"github.com/pion/webrtc/v4"
-	"tailscale.com/derp"
-	"tailscale.com/derp/derphttp"
-	"tailscale.com/net/netmon"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
-func NewSendOverlay(logger *slog.Logger, dm *tailcfg.DERPMap) *Send {
+// NewSendOverlay creates an overlay to the receiver of auth. A WebRTC
+// connection is only set up for browser receivers, as it fetches ICE servers
+// from wush.dev.
+func NewSendOverlay(logger *slog.Logger, dm *tailcfg.DERPMap, auth ClientAuth) *Send {
 	s := &Send{
+		Logger:           logger,
+		Auth:             auth,
+		SessionID:        uuid.NewString(),
+		sessionKey:       key.NewNode(),
 		derpMap:          dm,
 		in:               make(chan *tailcfg.Node, 8),
 		out:              make(chan *overlayMessage, 8),
-		waitIce:          make(chan struct{}),
+		greeted:          make(chan struct{}),
+		stopped:          make(chan struct{}),
 		WaitTransferDone: make(chan struct{}),
 		SelfIP:           randv6(),
 	}
-	s.setupWebrtcConnection()
+	if auth.Web {
+		s.setupWebrtcConnection()
+	}
 	return s
 }
 
@@ -43,215 +53,267 @@ type Send struct {
 	derpMap        *tailcfg.DERPMap
 
 	SelfIP netip.Addr
+	// ipv4 is the tailnet IPv4 address the receiver assigned us. It is set
+	// before greeted is closed.
+	ipv4 netip.Addr
 
 	Auth ClientAuth
+	// Identity is the persistent identity key of this client. Its public key
+	// is sent in the Hello so receivers can recognize us across connections.
+	Identity key.NodePrivate
+
+	// SessionID identifies us to the receiver across overlays.
+	SessionID string
+	// sessionKey is sent in the Hello, so the receiver can seal everything
+	// else to us with it instead of the auth key shared by all its senders.
+	// sessionKeyed is set once the receiver has used it.
+	sessionKey   key.NodePrivate
+	sessionKeyed atomic.Bool
+	// seq stamps the messages we send, and replay rejects replays of the
+	// receiver's.
+	seq    messageSeq
+	replay replayWindow
+
+	lastNode atomic.Pointer[tailcfg.Node]
+	// receiverHostInfo is from the receiver's first Hello response, and names
+	// its nodes.
+	receiverHostInfo atomic.Pointer[HostInfo]
+	// stunAddr is where the STUN overlay reaches the receiver. It starts as
+	// the address in the auth key, and follows the receiver's AddrUpdates.
+	stunAddr atomic.Pointer[netip.AddrPort]
+	// OnReconnect, if set, is called when an overlay to the receiver goes
+	// down, and when it comes back.
+	OnReconnect func(ReconnectEvent)
+	// greetOnce handles the first Hello response, after which greeted is
+	// closed.
+	greetOnce sync.Once
+	greeted   chan struct{}
+	// stopped is closed once ListenOverlay returns, with stopErr set to what
+	// it returned.
+	stopped  chan struct{}
+	stopErr  error
+	stopOnce sync.Once
+
+	transportsMu sync.Mutex
+	// transports are the overlays that are connected to the receiver, in
+	// the order they connected.
+	transports []*sendTransport
+	// active is the overlay messages are sent over.
+	active *sendTransport
 
 	RtcConn          *webrtc.PeerConnection
 	RtcDc            *webrtc.DataChannel
 	offer            webrtc.SessionDescription
-	waitIce          chan struct{}
 	WaitTransferDone chan struct{}
 
 	in  chan *tailcfg.Node
 	out chan *overlayMessage
 }
 
-func (s *Send) IPs() []netip.Addr {
-	return []netip.Addr{s.SelfIP}
+// IPs waits for the receiver to answer our Hello, as it assigns our IPv4
+// address. Receivers that predate IPv4 addresses don't, in which case we only
+// have an IPv6 one. It fails if ctx is done or ListenOverlay returns first, e.g.
+// because the receiver denied us.
+func (s *Send) IPs(ctx context.Context) ([]netip.Addr, error) {
+	select {
+	case <-s.greeted:
+	case <-s.stopped:
+		select {
+		case <-s.greeted:
+		default:
+			if s.stopErr != nil {
+				return nil, fmt.Errorf("overlay stopped before the receiver answered: %w", s.stopErr)
+			}
+			return nil, errors.New("overlay stopped before the receiver answered")
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !s.ipv4.IsValid() {
+		return []netip.Addr{s.SelfIP}, nil
+	}
+	return []netip.Addr{s.SelfIP, s.ipv4}, nil
 }
 
 func (s *Send) Recv() <-chan *tailcfg.Node {
 	return s.in
 }
 
+func (s *Send) AdmitDERP(ctx context.Context, nodeKey key.NodePublic) error {
+	return s.Auth.admitDERP(ctx, s.derpMap, nodeKey)
+}
+
+// Removed never fires, as the receiver is our only peer.
+func (s *Send) Removed() <-chan key.NodePublic {
+	return nil
+}
+
 func (s *Send) SendTailscaleNodeUpdate(node *tailcfg.Node) {
+	s.lastNode.Store(node.Clone())
 	s.out <- &overlayMessage{
 		Typ:  messageTypeNodeUpdate,
 		Node: *node.Clone(),
 	}
 }
 
-func (s *Send) ListenOverlaySTUN(ctx context.Context) error {
-	conn, err := net.ListenUDP("udp4", nil)
-	if err != nil {
-		return fmt.Errorf("listen STUN: %w", err)
-	}
+// sendTransport is a single overlay path to the receiver.
+type sendTransport struct {
+	name string
+	send func(sealed []byte) error
+}
 
-	go func() {
-		<-ctx.Done()
-		_ = conn.Close()
-	}()
+func (s *Send) addTransport(t *sendTransport) {
+	s.transportsMu.Lock()
+	defer s.transportsMu.Unlock()
+	s.transports = append(s.transports, t)
+}
 
-	sealed := s.newHelloPacket()
-	receiverAddr := s.Auth.ReceiverStunAddr
-	if s.STUNIPOverride.IsValid() {
-		receiverAddr = netip.AddrPortFrom(s.STUNIPOverride, s.Auth.ReceiverStunAddr.Port())
+// removeTransport forgets a dead overlay, failing over to another one if it
+// was active. Nothing is logged if we're shutting down.
+func (s *Send) removeTransport(t *sendTransport, shutdown bool) {
+	s.transportsMu.Lock()
+	s.transports = slices.DeleteFunc(s.transports, func(o *sendTransport) bool {
+		return o == t
+	})
+	if s.active != t {
+		s.transportsMu.Unlock()
+		return
 	}
-
-	_, err = conn.WriteToUDPAddrPort(sealed, receiverAddr)
-	if err != nil {
-		return fmt.Errorf("send overlay hello over STUN: %w", err)
+	s.active = nil
+	if len(s.transports) > 0 {
+		s.active = s.transports[0]
 	}
+	next := s.active
+	s.transportsMu.Unlock()
 
-	keepAlive := time.NewTicker(30 * time.Second)
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-s.out:
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal overlay msg: " + err.Error())
-				}
-
-				sealed := s.Auth.OverlayPrivateKey.SealTo(s.Auth.ReceiverPublicKey, raw)
-				_, err = conn.WriteToUDPAddrPort(sealed, receiverAddr)
-				if err != nil {
-					fmt.Printf("send response over STUN: %s\n", err)
-					return
-				}
-
-			case <-keepAlive.C:
-				msg := overlayMessage{
-					Typ: messageTypePing,
-				}
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal node: " + err.Error())
-				}
-
-				sealed := s.Auth.OverlayPrivateKey.SealTo(s.Auth.ReceiverPublicKey, raw)
-				_, err = conn.WriteToUDPAddrPort(sealed, receiverAddr)
-				if err != nil {
-					fmt.Printf("send ping message over STUN: %s\n", err)
-					return
-				}
-			}
-		}
-	}()
-
-	for {
-		buf := make([]byte, 4<<10)
-		n, addr, err := conn.ReadFromUDPAddrPort(buf)
-		if err != nil {
-			s.Logger.Error("read from STUN; exiting", "err", err)
-			return err
-		}
-
-		buf = buf[:n]
-
-		res, err := s.handleNextMessage(buf)
-		if err != nil {
-			fmt.Println(cliui.Timestamp(time.Now()), "Failed to handle overlay message:", err.Error())
-			continue
-		}
+	if shutdown {
+		return
+	}
+	if next == nil {
+		fmt.Println(cliui.Timestamp(time.Now()), "Lost connection to the receiver over", t.name)
+		return
+	}
 
-		if res != nil {
-			_, err = conn.WriteToUDPAddrPort(res, addr)
-			if err != nil {
-				fmt.Println(cliui.Timestamp(time.Now()), "Failed to send overlay response over STUN:", err.Error())
-				return err
-			}
-		}
+	fmt.Println(cliui.Timestamp(time.Now()), "Lost connection to the receiver over", t.name+", failing over to", next.name)
+	// Make sure the receiver can reach us over the new overlay.
+	if lastNode := s.lastNode.Load(); lastNode != nil {
+		s.sendOverlay(&overlayMessage{
+			Typ:  messageTypeNodeUpdate,
+			Node: *lastNode,
+		})
 	}
 }
 
-func (s *Send) ListenOverlayDERP(ctx context.Context) error {
-	derpPriv := key.NewNode()
-	c := derphttp.NewRegionClient(derpPriv, func(format string, args ...any) {}, netmon.NewStatic(), func() *tailcfg.DERPRegion {
-		return s.derpMap.Regions[int(s.Auth.ReceiverDERPRegionID)]
-	})
+// setActive makes t the active overlay if there isn't one yet. It reports
+// whether t became active.
+func (s *Send) setActive(t *sendTransport) bool {
+	s.transportsMu.Lock()
+	defer s.transportsMu.Unlock()
+	if s.active != nil {
+		return false
+	}
+	s.active = t
+	return true
+}
 
-	err := c.Connect(ctx)
-	if err != nil {
-		return err
+// sendOverlay sends msg over the active overlay. Until one is active it is
+// dropped, as the receiver would reject it anyway. Our latest node is sent
+// once the receiver answers our Hello.
+func (s *Send) sendOverlay(msg *overlayMessage) {
+	s.transportsMu.Lock()
+	active := s.active
+	s.transportsMu.Unlock()
+	if active == nil {
+		return
 	}
 
-	sealed := s.newHelloPacket()
-	err = c.Send(s.Auth.ReceiverPublicKey, sealed)
+	err := active.send(s.seal(*msg))
 	if err != nil {
-		return fmt.Errorf("send overlay hello over derp: %w", err)
+		fmt.Printf("send overlay message over %s: %s\n", active.name, err)
 	}
+}
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case msg := <-s.out:
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal overlay msg: " + err.Error())
-				}
-
-				sealed := s.Auth.OverlayPrivateKey.SealTo(s.Auth.ReceiverPublicKey, raw)
-				err = c.Send(s.Auth.ReceiverPublicKey, sealed)
-				if err != nil {
-					fmt.Printf("send response over derp: %s\n", err)
-					return
-				}
-			}
-		}
-	}()
+// keepAlive pings the receiver over t every keepAliveInterval until ctx is
+// done or alive returns false.
+func (s *Send) keepAlive(ctx context.Context, t *sendTransport, alive func() bool) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
 
 	for {
-		msg, err := c.Recv()
-		if err != nil {
-			return err
-		}
-
-		switch msg := msg.(type) {
-		case derp.ReceivedPacket:
-			if s.Auth.ReceiverPublicKey != msg.Source {
-				fmt.Printf("message from unknown peer %s\n", msg.Source.String())
-				continue
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !alive() {
+				return
 			}
-
-			res, err := s.handleNextMessage(msg.Data)
+			err := t.send(s.seal(overlayMessage{
+				Typ: messageTypePing,
+			}))
 			if err != nil {
-				fmt.Println("Failed to handle overlay message", err)
-				continue
-			}
-
-			if res != nil {
-				err = c.Send(msg.Source, res)
-				if err != nil {
-					fmt.Println(cliui.Timestamp(time.Now()), "Failed to send overlay response over derp:", err.Error())
-					return err
-				}
+				fmt.Printf("send ping message over %s: %s\n", t.name, err)
 			}
 		}
 	}
 }
 
-func (s *Send) newHelloPacket() []byte {
-	var (
-		username,
-		hostname string
-	)
+// Goodbye tells the receiver we're leaving over every overlay, so it can
+// remove us right away instead of waiting for our pings to stop.
+func (s *Send) Goodbye() {
+	s.transportsMu.Lock()
+	targets := slices.Clone(s.transports)
+	s.transportsMu.Unlock()
 
+	for _, t := range targets {
+		err := t.send(s.seal(overlayMessage{Typ: messageTypeGoodbye}))
+		if err != nil {
+			s.Logger.Debug("send goodbye", "overlay", t.name, "err", err)
+		}
+	}
+}
+
+// localHostInfo returns who we are, to tell peers in Hellos and their
+// responses.
+func localHostInfo() HostInfo {
+	var hi HostInfo
 	cu, _ := user.Current()
 	if cu != nil {
-		username = cu.Username
+		hi.Username = cu.Username
 	}
-	hostname, _ = os.Hostname()
-
-	raw, err := json.Marshal(overlayMessage{
-		Typ: messageTypeHello,
-		HostInfo: HostInfo{
-			Username: username,
-			Hostname: hostname,
-		},
-		WebrtcDescription: &s.offer,
-	})
-	if err != nil {
-		panic("marshal node: " + err.Error())
+	hi.Hostname, _ = os.Hostname()
+	return hi
+}
+
+func (s *Send) newHelloPacket() []byte {
+	hello := overlayMessage{
+		Typ:        messageTypeHello,
+		HostInfo:   localHostInfo(),
+		SessionID:  s.SessionID,
+		SessionKey: s.sessionKey.Public(),
+	}.withProtocol(cliFeatures)
+	if s.RtcConn != nil {
+		hello.WebrtcDescription = &s.offer
+	}
+	if !s.Identity.IsZero() {
+		hello.Identity = s.Identity.Public()
 	}
 
-	sealed := s.Auth.OverlayPrivateKey.SealTo(s.Auth.ReceiverPublicKey, raw)
-	return sealed
+	// The receiver doesn't know our session key until it has read this.
+	return s.sealWith(s.Auth.OverlayPrivateKey, hello)
+}
+
+// seal stamps msg with our session and sequence number, and seals it to the
+// receiver. Once the receiver uses our session key, so do we.
+func (s *Send) seal(msg overlayMessage) []byte {
+	if s.sessionKeyed.Load() {
+		return s.sealWith(s.sessionKey, msg)
+	}
+	return s.sealWith(s.Auth.OverlayPrivateKey, msg)
+}
+
+func (s *Send) sealWith(priv key.NodePrivate, msg overlayMessage) []byte {
+	msg.SessionID = s.SessionID
+	return priv.SealTo(s.Auth.ReceiverPublicKey, s.seq.marshal(msg))
 }
 
 const (
@@ -269,16 +331,36 @@ type RtcFileMetadata struct {
 	FileSize int    `json:"fileSize"`
 }
 
-func (s *Send) handleNextMessage(msg []byte) (resRaw []byte, _ error) {
-	cleartext, ok := s.Auth.OverlayPrivateKey.OpenFrom(s.Auth.ReceiverPublicKey, msg)
+// ErrDenied is returned when the receiver denies our connection request.
+var ErrDenied = errors.New("connection request was denied by the receiver")
+
+// isFatal reports whether err means the receiver won't talk to us over any
+// overlay, so there's no point in keeping the others around.
+func isFatal(err error) bool {
+	return errors.Is(err, ErrDenied) || errors.Is(err, ErrIncompatible)
+}
+
+func (s *Send) handleNextMessage(t *sendTransport, msg []byte) (resRaw []byte, _ error) {
+	cleartext, ok := s.sessionKey.OpenFrom(s.Auth.ReceiverPublicKey, msg)
+	if ok {
+		s.sessionKeyed.Store(true)
+	} else if !s.sessionKeyed.Load() {
+		// Receivers that predate session keys only use the auth key. Once
+		// the receiver has used ours, anything else could be from another
+		// sender holding the auth key.
+		cleartext, ok = s.Auth.OverlayPrivateKey.OpenFrom(s.Auth.ReceiverPublicKey, msg)
+	}
 	if !ok {
 		return nil, errors.New("message failed decryption")
 	}
 
-	var ovMsg overlayMessage
-	err := json.Unmarshal(cleartext, &ovMsg)
+	ovMsg, err := decodeOverlayMessage(cleartext)
+	if err != nil {
+		return nil, err
+	}
+	err = s.replay.check(ovMsg, time.Now())
 	if err != nil {
-		panic("unmarshal node: " + err.Error())
+		return nil, err
 	}
 
 	res := overlayMessage{}
@@ -288,26 +370,82 @@ func (s *Send) handleNextMessage(msg []byte) (resRaw []byte, _ error) {
 	case messageTypePong:
 		// do nothing
 	case messageTypeHelloResponse:
-		s.in <- &ovMsg.Node
-		close(s.waitIce)
-		s.RtcConn.SetRemoteDescription(*ovMsg.WebrtcDescription)
+		if err := checkProtocol(ovMsg); err != nil {
+			return nil, err
+		}
+		if s.setActive(t) {
+			s.Logger.Debug("connected to receiver",
+				"overlay", t.name,
+				"version", ovMsg.ProtocolVersion,
+				"features", negotiateFeatures(cliFeatures, ovMsg.Features),
+			)
+			s.receiverHostInfo.Store(&ovMsg.HostInfo)
+			nameNode(&ovMsg.Node, ovMsg.HostInfo)
+			s.in <- &ovMsg.Node
+			// Only the first overlay to answer carries our IPv4 address and
+			// the WebRTC answer. Later ones are from overlays reconnecting.
+			s.greetOnce.Do(func() {
+				if ovMsg.IPv4 != nil && TailnetIPv4Prefix.Contains(*ovMsg.IPv4) {
+					s.ipv4 = *ovMsg.IPv4
+				}
+				close(s.greeted)
+				if ovMsg.WebrtcDescription != nil && s.RtcConn != nil {
+					s.RtcConn.SetRemoteDescription(*ovMsg.WebrtcDescription)
+				}
+			})
+		}
+		// Our node may have been sent before the receiver approved us, in
+		// which case it was dropped.
+		if lastNode := s.lastNode.Load(); lastNode != nil {
+			res.Typ = messageTypeNodeUpdate
+			res.Node = *lastNode
+		}
+	case messageTypeHelloDenied:
+		return nil, ErrDenied
+	case messageTypeHelloIncompatible:
+		err := checkProtocol(ovMsg)
+		if err == nil {
+			// The receiver can't talk to us, even though we can talk to it.
+			err = ErrIncompatible
+		}
+		return nil, err
+	case messageTypeIdentityChallenge:
+		if s.Identity.IsZero() {
+			break
+		}
+		res.Typ = messageTypeIdentityProof
+		res.IdentityProof = s.Identity.SealTo(s.Auth.ReceiverPublicKey, ovMsg.Challenge)
 	case messageTypeNodeUpdate:
+		if hi := s.receiverHostInfo.Load(); hi != nil {
+			nameNode(&ovMsg.Node, *hi)
+		}
 		s.in <- &ovMsg.Node
+	case messageTypeAddrUpdate:
+		// Only the STUN overlay uses the address, and only if it's in the
+		// auth key.
+		if ovMsg.STUNAddr == nil || !ovMsg.STUNAddr.IsValid() || s.stunAddr.Load() == nil {
+			break
+		}
+		s.Logger.Debug("receiver's STUN address changed", "addr", ovMsg.STUNAddr.String())
+		s.setSTUNAddr(*ovMsg.STUNAddr)
 	case messageTypeWebRTCCandidate:
-		s.RtcConn.AddICECandidate(*ovMsg.WebrtcCandidate)
+		if ovMsg.WebrtcCandidate == nil {
+			return nil, errors.New("webrtc candidate message is missing the candidate")
+		}
+		if s.RtcConn != nil {
+			s.RtcConn.AddICECandidate(*ovMsg.WebrtcCandidate)
+		}
+	default:
+		// Likely from a newer receiver, which must not rely on us
+		// understanding it.
+		s.Logger.Debug("ignoring unsupported overlay message", "type", ovMsg.Typ.String())
 	}
 
 	if res.Typ == 0 {
 		return nil, nil
 	}
 
-	raw, err := json.Marshal(res)
-	if err != nil {
-		panic("marshal node: " + err.Error())
-	}
-
-	sealed := s.Auth.OverlayPrivateKey.SealTo(s.Auth.ReceiverPublicKey, raw)
-	return sealed, nil
+	return s.seal(res), nil
 }
 
 func (s *Send) setupWebrtcConnection() {
@@ -323,7 +461,7 @@ func (s *Send) setupWebrtcConnection() {
 		}
 		ic := i.ToJSON()
 
-		<-s.waitIce
+		<-s.greeted
 		s.out <- &overlayMessage{
 			Typ:             messageTypeWebRTCCandidate,
 			WebrtcCandidate: &ic,
@@ -0,0 +1,82 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+)
+
+func TestSendIPs(t *testing.T) {
+	errDenied := errors.New("receiver denied us")
+	ipv4 := netip.MustParseAddr("100.64.0.2")
+
+	for _, tc := range []struct {
+		name    string
+		setup   func(s *Send, cancel context.CancelFunc)
+		wantErr error
+		want    int
+	}{
+		{
+			name: "Greeted",
+			setup: func(s *Send, _ context.CancelFunc) {
+				s.ipv4 = ipv4
+				close(s.greeted)
+			},
+			want: 2,
+		},
+		{
+			name:  "GreetedLegacy",
+			setup: func(s *Send, _ context.CancelFunc) { close(s.greeted) },
+			want:  1,
+		},
+		{
+			name: "GreetedThenStopped",
+			setup: func(s *Send, _ context.CancelFunc) {
+				close(s.greeted)
+				s.stopErr = errDenied
+				close(s.stopped)
+			},
+			want: 1,
+		},
+		{
+			name: "Stopped",
+			setup: func(s *Send, _ context.CancelFunc) {
+				s.stopErr = errDenied
+				close(s.stopped)
+			},
+			wantErr: errDenied,
+		},
+		{
+			name:    "Canceled",
+			setup:   func(_ *Send, cancel context.CancelFunc) { cancel() },
+			wantErr: context.Canceled,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewSendOverlay(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, ClientAuth{})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			tc.setup(s, cancel)
+
+			ips, err := s.IPs(ctx)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != tc.want || ips[0] != s.SelfIP {
+				t.Fatalf("got IPs %v, want %d starting with %v", ips, tc.want, s.SelfIP)
+			}
+		})
+	}
+}
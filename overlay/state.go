@@ -0,0 +1,86 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"tailscale.com/types/key"
+
+	"github.com/coder/wush/cliui"
+)
+
+// receiveState is the identity of a receiver that is persisted across
+// restarts, so that previously printed auth keys remain valid.
+type receiveState struct {
+	SelfPriv     key.NodePrivate `json:"self_priv"`
+	DERPRegionID uint16          `json:"derp_region_id"`
+	Keys         []*PeerKey      `json:"keys"`
+	// ControlPriv is missing from state saved by versions that generated it
+	// on every start.
+	ControlPriv key.MachinePrivate `json:"control_priv"`
+}
+
+// LoadState restores the receiver's overlay and control keys and DERP home from
+// path. If the file does not exist, an error satisfying
+// errors.Is(err, fs.ErrNotExist) is returned and the receiver is left unchanged.
+func (r *Receive) LoadState(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var state receiveState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("unmarshal receiver state: %w", err)
+	}
+
+	r.SelfPriv = state.SelfPriv
+	r.Keys = &KeyRing{keys: state.Keys}
+	if !state.ControlPriv.IsZero() {
+		r.ControlPriv = state.ControlPriv
+	}
+	if region := r.DerpMap.Regions[int(state.DERPRegionID)]; region != nil {
+		r.HumanLogf("Using saved DERP region %s as overlay home", cliui.Code(region.RegionName))
+		r.derpRegionID = state.DERPRegionID
+	}
+	return nil
+}
+
+// SaveState writes the receiver's overlay and control keys and DERP home to
+// path. The file contains private keys, so it is only readable by the current
+// user.
+func (r *Receive) SaveState(path string) error {
+	data, err := json.MarshalIndent(receiveState{
+		SelfPriv:     r.SelfPriv,
+		DERPRegionID: r.derpRegionID,
+		Keys:         r.Keys.Keys(),
+		ControlPriv:  r.ControlPriv,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal receiver state: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("write receiver state: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// DERPRegionID returns the DERP region used as the overlay home, or 0 if none
+// has been picked.
+func (r *Receive) DERPRegionID() uint16 {
+	return r.derpRegionID
+}
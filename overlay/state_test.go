@@ -0,0 +1,113 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestState(t *testing.T) {
+	dm := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		900: {RegionID: 900, RegionName: "custom"},
+	}}
+	newReceive := func() *Receive {
+		return NewReceiveOverlay(slog.New(slog.NewTextHandler(io.Discard, nil)), t.Logf, dm)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// write prepares the state file at path, and returns the receiver
+		// loading it should restore, if any.
+		write   func(t *testing.T, path string) *Receive
+		wantErr error
+	}{
+		{
+			name:    "Missing",
+			write:   func(*testing.T, string) *Receive { return nil },
+			wantErr: fs.ErrNotExist,
+		},
+		{
+			name: "Corrupt",
+			write: func(t *testing.T, path string) *Receive {
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "RoundTrip",
+			write: func(t *testing.T, path string) *Receive {
+				r := newReceive()
+				r.derpRegionID = 900
+				if _, err := r.Keys.Mint("default", Policy{Scope: ScopeSSH}); err != nil {
+					t.Fatal(err)
+				}
+				if err := r.SaveState(path); err != nil {
+					t.Fatal(err)
+				}
+				return r
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// SaveState creates the directory.
+			path := filepath.Join(t.TempDir(), "wush", "state.json")
+			want := tc.write(t, path)
+
+			r := newReceive()
+			selfPriv := r.SelfPriv
+			err := r.LoadState(path)
+			if want == nil {
+				if err == nil {
+					t.Fatal("loaded invalid state")
+				}
+				if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tc.wantErr)
+				}
+				if !r.SelfPriv.Equal(selfPriv) {
+					t.Fatal("receiver changed after failing to load state")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != 0o600 {
+				t.Fatalf("state file has mode %v, want 0600", fi.Mode().Perm())
+			}
+
+			if !r.SelfPriv.Equal(want.SelfPriv) {
+				t.Error("overlay key wasn't restored")
+			}
+			if !r.ControlPriv.Equal(want.ControlPriv) {
+				t.Error("control key wasn't restored")
+			}
+			if r.DERPRegionID() != 900 {
+				t.Errorf("got DERP region %d, want 900", r.DERPRegionID())
+			}
+			got, ok := r.Keys.Get("default")
+			wantKey, _ := want.Keys.Get("default")
+			if !ok || !got.Priv.Equal(wantKey.Priv) || got.Scope != wantKey.Scope {
+				t.Errorf("got key %+v, want %+v", got, wantKey)
+			}
+		})
+	}
+}
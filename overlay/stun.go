@@ -0,0 +1,342 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"tailscale.com/net/stun"
+
+	"github.com/coder/pretty"
+	"github.com/coder/wush/cliui"
+)
+
+func init() {
+	RegisterTransport("stun", stunTransport{})
+}
+
+// DefaultSTUNServers are the STUN servers used when Receive.STUNServers is
+// empty.
+var DefaultSTUNServers = []string{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+
+// stunInterval is how often we ask the STUN servers for our address, which
+// also keeps the NAT mapping of the overlay socket alive.
+const stunInterval = 30 * time.Second
+
+// natType is how our NAT maps the overlay socket, going by the addresses STUN
+// servers see us at.
+type natType int
+
+const (
+	// natUnknown means fewer than two STUN servers have answered at once,
+	// so there was nothing to compare.
+	natUnknown natType = iota
+	// natEasy maps the socket to the same address for every destination,
+	// so peers can reach us at our STUN address.
+	natEasy
+	// natHard, or symmetric NAT, maps the socket to a different address for
+	// every destination, so peers can't reach us at our STUN address.
+	natHard
+)
+
+func (t natType) String() string {
+	switch t {
+	case natEasy:
+		return "easy"
+	case natHard:
+		return "hard"
+	default:
+		return "unknown"
+	}
+}
+
+// stunTransport listens for peers on a socket whose public address is found
+// with STUN. The NAT has to let senders through to it, so it doesn't work
+// with hard NAT.
+type stunTransport struct{}
+
+func (stunTransport) Name() string { return "STUN" }
+
+// Listen asks every STUN server for our address every stunInterval, so the
+// others are a fallback if one is down, and comparing their answers tells us
+// whether our NAT makes the address unusable. ready is closed once we have an
+// address. If it changes later, e.g. because our NAT rebound the socket,
+// connected peers are told the new one.
+func (stunTransport) Listen(ctx context.Context, r *Receive) (ListenConn, <-chan struct{}, error) {
+	network := "udp4"
+	if r.STUNIPv6 {
+		network = "udp6"
+	}
+	servers := r.STUNServers
+	if len(servers) == 0 {
+		servers = DefaultSTUNServers
+	}
+	sc, err := newSTUNClient(network, servers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen STUN: %w", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(stunInterval)
+		defer ticker.Stop()
+
+		for {
+			reqs, unanswered := sc.nextRound()
+			if unanswered {
+				r.Logger.Debug("no STUN server answered")
+			}
+			var werr error
+			sent := 0
+			for _, req := range reqs {
+				_, err := conn.WriteToUDPAddrPort(stun.Request(req.tx), req.server)
+				if err != nil {
+					werr = err
+					continue
+				}
+				sent++
+			}
+			if sent == 0 {
+				r.HumanLogf("%s Failed to write STUN request on overlay: %s", cliui.Timestamp(time.Now()), werr)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	ipChan := make(chan struct{})
+	var closeIPChanOnce sync.Once
+
+	intercept := func(buf []byte) bool {
+		if !stun.Is(buf) {
+			return false
+		}
+
+		tx, addr, err := stun.ParseResponse(buf)
+		if err != nil {
+			r.Logger.Error("decode STUN response", "err", err)
+			return true
+		}
+		stunAddrPort := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		ans, ok := sc.answer(tx, stunAddrPort)
+		if !ok {
+			r.Logger.Debug("ignoring unexpected STUN message", "addr", stunAddrPort.String())
+			return true
+		}
+		if ans.natChanged {
+			r.natTypeChanged(ans.nat)
+		}
+		if !ans.use {
+			return true
+		}
+
+		prev := r.stunIP.Swap(&stunAddrPort)
+		// our first STUN response
+		if prev == nil {
+			r.HumanLogf("STUN address is %s", cliui.Code(stunAddrPort.String()))
+		} else if *prev != stunAddrPort {
+			r.stunAddrChanged(*prev, stunAddrPort)
+		}
+		closeIPChanOnce.Do(func() {
+			close(ipChan)
+		})
+		return true
+	}
+	return &udpListenConn{conn: conn, intercept: intercept}, ipChan, nil
+}
+
+// Dial reaches the receiver at the UDP address in the auth key, which is also
+// where direct receivers are.
+func (stunTransport) Dial(ctx context.Context, s *Send) (DialConn, error) {
+	if !s.Auth.ReceiverStunAddr.IsValid() {
+		return nil, nil
+	}
+
+	s.setSTUNAddr(s.Auth.ReceiverStunAddr)
+	conn, err := newUDPDialConn(udpNetwork(s.Auth.ReceiverStunAddr), &s.stunAddr, func(context.Context, *net.UDPConn) (netip.AddrPort, error) {
+		return *s.stunAddr.Load(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listen STUN: %w", err)
+	}
+	return conn, nil
+}
+
+// setSTUNAddr points the STUN overlay at addr, keeping STUNIPOverride.
+func (s *Send) setSTUNAddr(addr netip.AddrPort) {
+	if s.STUNIPOverride.IsValid() {
+		addr = netip.AddrPortFrom(s.STUNIPOverride, addr.Port())
+	}
+	s.stunAddr.Store(&addr)
+}
+
+// natTypeChanged reports what the STUN servers found out about our NAT.
+func (r *Receive) natTypeChanged(nat natType) {
+	r.Logger.Info("detected NAT type", "nat", nat.String())
+	if nat == natHard {
+		r.HumanLogf(pretty.Sprintf(cliui.DefaultStyles.Warn,
+			"Detected hard NAT, which maps each destination to a different port. Clients likely can't connect over the STUN overlay; use %s instead.",
+			cliui.Code("--overlay-type derp"),
+		))
+	}
+}
+
+// stunAddrChanged tells connected peers our new STUN address, so they keep
+// reaching us over the STUN overlay.
+func (r *Receive) stunAddrChanged(prev, addr netip.AddrPort) {
+	r.HumanLogf("%s STUN address changed from %s to %s, telling connected peers",
+		cliui.Timestamp(time.Now()), cliui.Code(prev.String()), cliui.Code(addr.String()),
+	)
+	// This runs on the STUN overlay's receive loop, which must not wait on
+	// the fan-out.
+	select {
+	case r.out <- &overlayMessage{
+		Typ:      messageTypeAddrUpdate,
+		STUNAddr: &addr,
+	}:
+	default:
+		r.Logger.Warn("overlay is not keeping up; dropped STUN address update", "addr", addr.String())
+	}
+	if r.OnSTUNAddrChange != nil {
+		r.OnSTUNAddrChange(addr)
+	}
+}
+
+// stunClient keeps track of the binding requests sent to each STUN server, and
+// which of their answers our STUN address comes from.
+type stunClient struct {
+	servers []netip.AddrPort
+
+	mu sync.Mutex
+	// txs maps the transaction IDs of the current round of requests to the
+	// index of the server they were sent to.
+	txs map[stun.TxID]int
+	// mapped are the addresses each server saw us at in the current round.
+	mapped map[int]netip.AddrPort
+	// current is the index of the server our STUN address comes from, or -1
+	// if there isn't one yet.
+	current int
+	nat     natType
+}
+
+type stunRequest struct {
+	server netip.AddrPort
+	tx     stun.TxID
+}
+
+// stunAnswer is what to do with a STUN server's answer.
+type stunAnswer struct {
+	// use is whether the answer is from the server our STUN address comes
+	// from.
+	use bool
+	// natChanged is set if comparing the answers changed what we know about
+	// our NAT, to nat.
+	natChanged bool
+	nat        natType
+}
+
+// newSTUNClient resolves servers for network. Servers that don't resolve are
+// skipped, as long as one does.
+func newSTUNClient(network string, servers []string) (*stunClient, error) {
+	sc := &stunClient{current: -1}
+
+	var errs error
+	for _, server := range servers {
+		addr, err := net.ResolveUDPAddr(network, server)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("resolve STUN server %s: %w", server, err))
+			continue
+		}
+		ap := addr.AddrPort()
+		ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		// Answers from the same IP can't tell us anything about our NAT.
+		if slices.ContainsFunc(sc.servers, func(s netip.AddrPort) bool { return s.Addr() == ap.Addr() }) {
+			continue
+		}
+		sc.servers = append(sc.servers, ap)
+	}
+	if len(sc.servers) == 0 {
+		if errs == nil {
+			errs = errors.New("no STUN servers configured")
+		}
+		return nil, errs
+	}
+	return sc, nil
+}
+
+// nextRound starts a new round of requests to every server. If the server our
+// STUN address comes from didn't answer the last round, we fall back to
+// whichever answers first. unanswered reports whether no server answered the
+// last round.
+func (sc *stunClient) nextRound() (reqs []stunRequest, unanswered bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	unanswered = sc.txs != nil && len(sc.mapped) == 0
+	if _, ok := sc.mapped[sc.current]; !ok {
+		sc.current = -1
+	}
+
+	sc.txs = make(map[stun.TxID]int, len(sc.servers))
+	sc.mapped = make(map[int]netip.AddrPort, len(sc.servers))
+	for i, server := range sc.servers {
+		tx := stun.NewTxID()
+		sc.txs[tx] = i
+		reqs = append(reqs, stunRequest{server: server, tx: tx})
+	}
+	return reqs, unanswered
+}
+
+// answer records that the server we sent tx to saw us at addr. ok is false if
+// tx isn't from the current round.
+func (sc *stunClient) answer(tx stun.TxID, addr netip.AddrPort) (ans stunAnswer, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	i, ok := sc.txs[tx]
+	if !ok {
+		return ans, false
+	}
+	delete(sc.txs, tx)
+	sc.mapped[i] = addr
+
+	// Servers at different IPs seeing us at different addresses means our
+	// NAT maps each destination separately.
+	if len(sc.mapped) >= 2 {
+		nat := natEasy
+		for _, other := range sc.mapped {
+			if other != addr {
+				nat = natHard
+				break
+			}
+		}
+		if nat != sc.nat {
+			sc.nat = nat
+			ans.natChanged = true
+			ans.nat = nat
+		}
+	}
+
+	if sc.current == -1 {
+		sc.current = i
+	}
+	ans.use = i == sc.current
+	return ans, true
+}
@@ -0,0 +1,384 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/puzpuzpuz/xsync/v3"
+	"tailscale.com/types/key"
+
+	"github.com/coder/wush/cliui"
+)
+
+// Transport is a medium that senders and receivers exchange sealed overlay
+// messages over, e.g. DERP or UDP. Transports are registered by name with
+// RegisterTransport. Sealing, sessions, replay protection and fanning out node
+// updates are handled the same way for all of them.
+type Transport interface {
+	// Name is what the transport is called in logs, e.g. "DERP".
+	Name() string
+	// Listen starts listening for senders to r. ready is closed once r can
+	// put the transport in its auth keys.
+	Listen(ctx context.Context, r *Receive) (conn ListenConn, ready <-chan struct{}, _ error)
+	// Dial returns a conn to the receiver of s.Auth, or nil if the auth key
+	// doesn't have the receiver on this transport.
+	Dial(ctx context.Context, s *Send) (DialConn, error)
+}
+
+// Frame is a sealed overlay message received over a transport.
+type Frame struct {
+	// From is the peer that sent it.
+	From PeerAddr
+	// Data is the sealed message. It is empty for transport messages that
+	// only show the connection works, e.g. DERP keepalives.
+	Data []byte
+}
+
+// PeerAddr is where a peer is on a transport, e.g. its DERP key or UDP
+// address. Receivers tell senders apart by its String, so it must be unique
+// to the peer on the transport.
+type PeerAddr interface {
+	String() string
+}
+
+// Conn carries sealed overlay messages over a transport. Connect is called
+// before the first Recv, and again to reconnect once Recv fails.
+type Conn interface {
+	Connect(ctx context.Context) error
+	// Recv blocks until the next frame arrives.
+	Recv() (Frame, error)
+	Close() error
+}
+
+// ListenConn is a receiver's Conn, which any sender can send to.
+type ListenConn interface {
+	Conn
+	// SendTo sends a sealed message to the peer at to.
+	SendTo(to PeerAddr, sealed []byte) error
+}
+
+// DialConn is a sender's Conn to the receiver.
+type DialConn interface {
+	Conn
+	// Send sends a sealed message to the receiver.
+	Send(sealed []byte) error
+}
+
+// deadliner is implemented by DialConns that can't tell by themselves that
+// the receiver is gone. Once nothing has been heard from it for deadAfter,
+// their Recv is unblocked with a deadline.
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+var (
+	transportsMu   sync.RWMutex
+	transports     = map[string]Transport{}
+	transportNames []string
+)
+
+// RegisterTransport makes t available to Receive.ListenOverlay as name, and
+// to senders whose auth key has the receiver on it. It panics if name is
+// already registered.
+func RegisterTransport(name string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if _, ok := transports[name]; ok {
+		panic(fmt.Sprintf("overlay transport %q is already registered", name))
+	}
+	transports[name] = t
+	transportNames = append(transportNames, name)
+}
+
+// TransportNames returns the names of the registered transports, in the
+// order they were registered.
+func TransportNames() []string {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	return append([]string(nil), transportNames...)
+}
+
+func lookupTransport(name string) (Transport, bool) {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	t, ok := transports[name]
+	return t, ok
+}
+
+// ListenOverlay listens for senders over the transport registered as name,
+// until ctx is done. The returned channel is closed once the transport can be
+// put in auth keys.
+func (r *Receive) ListenOverlay(ctx context.Context, name string) (<-chan struct{}, error) {
+	t, ok := lookupTransport(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown overlay type %q", name)
+	}
+
+	conn, ready, err := t.Listen(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	go r.serve(ctx, t.Name(), conn)
+	return ready, nil
+}
+
+// overlayPeer is how to reach a peer over the overlay, along with the label of
+// the key it authenticated with. Overlays keep them keyed by overlay address,
+// and stop sending to them once the address has been removed.
+type overlayPeer struct {
+	addr     PeerAddr
+	keyLabel string
+}
+
+// serve exchanges overlay messages with senders over conn until ctx is done.
+func (r *Receive) serve(ctx context.Context, system string, conn ListenConn) {
+	// overlay addr -> transport addr
+	peers := xsync.NewMapOf[string, overlayPeer]()
+	out := r.subscribe(ctx)
+	r.startEviction(ctx)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-out:
+				raw := r.seq.marshal(*msg)
+
+				peers.Range(func(srcAddr string, peer overlayPeer) bool {
+					sealed, ok := r.sealTo(srcAddr, peer.keyLabel, raw)
+					if _, joined := r.addrSession.Load(srcAddr); !ok || !joined {
+						peers.Delete(srcAddr)
+						return true
+					}
+					err := conn.SendTo(peer.addr, sealed)
+					if err != nil {
+						// Other peers must still get the update.
+						r.HumanLogf("%s Failed to send updated node over %s: %s", cliui.Timestamp(time.Now()), system, err)
+					}
+					return true
+				})
+			}
+		}
+	}()
+
+	_ = reconnectLoop(ctx, system, r.OnReconnect, func(ctx context.Context, connected func()) error {
+		err := conn.Connect(ctx)
+		if err != nil {
+			return err
+		}
+
+		for {
+			frame, err := conn.Recv()
+			if err != nil {
+				return err
+			}
+			connected()
+			if len(frame.Data) == 0 {
+				continue
+			}
+
+			srcAddr := frame.From.String()
+			reply := func(b []byte) error {
+				return conn.SendTo(frame.From, b)
+			}
+			res, keyLabel, err := r.handleFrame(frame, system, reply)
+			if errors.Is(err, errReplayed) {
+				// Senders seal every copy of a message they send over
+				// different overlays separately, so this is a replay, or
+				// a duplicate from the network at best.
+				r.Logger.Warn("dropped replayed overlay message", "addr", srcAddr, "system", system)
+				continue
+			}
+			if err != nil {
+				r.HumanLogf("Failed to handle overlay message over %s: %s", system, err.Error())
+				continue
+			}
+
+			if r.peerAccepted(srcAddr) {
+				peers.Store(srcAddr, overlayPeer{addr: frame.From, keyLabel: keyLabel})
+			}
+
+			if res != nil {
+				err = conn.SendTo(frame.From, res)
+				if err != nil {
+					return fmt.Errorf("send overlay response over %s: %w", system, err)
+				}
+			}
+		}
+	})
+}
+
+// handleFrame handles a sealed message that arrived over the transport called
+// system.
+func (r *Receive) handleFrame(frame Frame, system string, reply func([]byte) error) (resRaw []byte, keyLabel string, _ error) {
+	// Only DERP addresses senders by their key.
+	src, _ := frame.From.(key.NodePublic)
+	return r.handleNextMessage(src, frame.From.String(), frame.Data, system, reply)
+}
+
+// ListenOverlay connects to the receiver over every registered transport the
+// auth key has it on at once. Messages are sent over whichever answers first,
+// failing over to the others if it dies. Overlays that die reconnect with
+// backoff, reporting to OnReconnect. It only returns once ctx is done, or if
+// the receiver denies the connection.
+func (s *Send) ListenOverlay(ctx context.Context) error {
+	err := s.listenOverlay(ctx)
+	s.stopOnce.Do(func() {
+		s.stopErr = err
+		close(s.stopped)
+	})
+	return err
+}
+
+func (s *Send) listenOverlay(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialed struct {
+		name string
+		conn DialConn
+	}
+	var conns []dialed
+	for _, name := range TransportNames() {
+		t, _ := lookupTransport(name)
+		conn, err := t.Dial(ctx, s)
+		if err != nil {
+			for _, d := range conns {
+				_ = d.conn.Close()
+			}
+			return fmt.Errorf("dial %s: %w", t.Name(), err)
+		}
+		if conn != nil {
+			conns = append(conns, dialed{name: t.Name(), conn: conn})
+		}
+	}
+	if len(conns) == 0 {
+		return errors.New("auth key provided no overlays")
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-s.out:
+				s.sendOverlay(msg)
+			}
+		}
+	}()
+
+	errs := make(chan error, len(conns))
+	for _, d := range conns {
+		go func() {
+			go func() {
+				<-ctx.Done()
+				_ = d.conn.Close()
+			}()
+			errs <- s.dial(ctx, d.name, d.conn)
+		}()
+	}
+
+	var err error
+	for range conns {
+		lerr := <-errs
+		if isFatal(lerr) {
+			return lerr
+		}
+		err = errors.Join(err, lerr)
+	}
+	return err
+}
+
+// dial exchanges overlay messages with the receiver over conn, until ctx is
+// done or the receiver won't talk to us.
+func (s *Send) dial(ctx context.Context, name string, conn DialConn) error {
+	return reconnectLoop(ctx, name, s.OnReconnect, func(ctx context.Context, connected func()) error {
+		err := conn.Connect(ctx)
+		if err != nil {
+			return err
+		}
+
+		t := &sendTransport{
+			name: name,
+			send: conn.Send,
+		}
+
+		err = t.send(s.newHelloPacket())
+		if err != nil {
+			return fmt.Errorf("send overlay hello over %s: %w", name, err)
+		}
+		s.addTransport(t)
+		defer func() {
+			s.removeTransport(t, ctx.Err() != nil)
+		}()
+
+		keepAliveCtx, stopKeepAlive := context.WithCancel(ctx)
+		defer stopKeepAlive()
+
+		var lastRecv atomic.Int64
+		lastRecv.Store(time.Now().UnixNano())
+		alive := func() bool { return true }
+		// DERP tells us if the connection breaks, but over UDP only the
+		// receiver's answers to our pings do.
+		dl, hasDeadline := conn.(deadliner)
+		if hasDeadline {
+			_ = dl.SetReadDeadline(time.Time{})
+			alive = func() bool {
+				if time.Since(time.Unix(0, lastRecv.Load())) > deadAfter {
+					// Unblock the read loop below.
+					_ = dl.SetReadDeadline(time.Now())
+					return false
+				}
+				return true
+			}
+		}
+		go s.keepAlive(keepAliveCtx, t, alive)
+
+		for {
+			frame, err := conn.Recv()
+			if hasDeadline && errors.Is(err, os.ErrDeadlineExceeded) {
+				return errors.New("receiver stopped responding")
+			}
+			if err != nil {
+				s.Logger.Debug("read from "+name, "err", err)
+				return err
+			}
+			if len(frame.Data) == 0 {
+				continue
+			}
+
+			res, err := s.handleNextMessage(t, frame.Data)
+			if isFatal(err) {
+				return err
+			}
+			if err != nil {
+				fmt.Println(cliui.Timestamp(time.Now()), "Failed to handle overlay message over", name+":", err.Error())
+				continue
+			}
+			lastRecv.Store(time.Now().UnixNano())
+			connected()
+
+			if res != nil {
+				err = conn.Send(res)
+				if err != nil {
+					return fmt.Errorf("send overlay response over %s: %w", name, err)
+				}
+			}
+		}
+	})
+}
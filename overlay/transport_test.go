@@ -0,0 +1,106 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestReceiveDropsReplayedFrames(t *testing.T) {
+	for _, tc := range []struct {
+		system string
+		from   PeerAddr
+	}{
+		{system: "STUN", from: netip.MustParseAddrPort("203.0.113.7:41641")},
+		{system: "DERP", from: key.NewNode().Public()},
+	} {
+		t.Run(tc.system, func(t *testing.T) {
+			r := NewReceiveOverlay(slog.New(slog.NewTextHandler(io.Discard, nil)), t.Logf, &tailcfg.DERPMap{})
+			pk, err := r.Keys.Mint("default", Policy{Scope: ScopeAll})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var seq messageSeq
+			frame := Frame{
+				From: tc.from,
+				Data: pk.Priv.SealTo(r.SelfPriv.Public(), seq.marshal(overlayMessage{Typ: messageTypePing})),
+			}
+			reply := func([]byte) error { return nil }
+
+			res, _, err := r.handleFrame(frame, tc.system, reply)
+			if err != nil {
+				t.Fatalf("first copy rejected: %v", err)
+			}
+			if res == nil {
+				t.Fatal("first copy wasn't answered")
+			}
+
+			res, _, err = r.handleFrame(frame, tc.system, reply)
+			if !errors.Is(err, errReplayed) {
+				t.Fatalf("second copy wasn't dropped as a replay, got %v", err)
+			}
+			if res != nil {
+				t.Fatal("second copy was answered")
+			}
+		})
+	}
+}
+
+func TestReceiveRequiresSessionKey(t *testing.T) {
+	r := NewReceiveOverlay(slog.New(slog.NewTextHandler(io.Discard, nil)), t.Logf, &tailcfg.DERPMap{})
+	pk, err := r.Keys.Mint("default", Policy{Scope: ScopeAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSendOverlay(slog.New(slog.NewTextHandler(io.Discard, nil)), &tailcfg.DERPMap{}, ClientAuth{
+		OverlayPrivateKey: pk.Priv,
+		ReceiverPublicKey: r.SelfPriv.Public(),
+	})
+	from := netip.MustParseAddrPort("203.0.113.7:41641")
+	reply := func([]byte) error { return nil }
+
+	_, _, err = r.handleFrame(Frame{From: from, Data: s.newHelloPacket()}, "STUN", reply)
+	if err != nil {
+		t.Fatalf("hello rejected: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    func() []byte
+		wantErr bool
+	}{
+		{
+			name:    "AuthKey",
+			data:    func() []byte { return s.sealWith(pk.Priv, overlayMessage{Typ: messageTypePing}) },
+			wantErr: true,
+		},
+		{
+			name: "SessionKey",
+			data: func() []byte { return s.sealWith(s.sessionKey, overlayMessage{Typ: messageTypePing}) },
+		},
+		{
+			// Hellos are resent with the auth key when overlays reconnect.
+			name: "AuthKeyHello",
+			data: s.newHelloPacket,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := r.handleFrame(Frame{From: from, Data: tc.data()}, "STUN", reply)
+			if tc.wantErr && err == nil {
+				t.Fatal("message was accepted")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("message rejected: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+//go:build !js && !wasm
+// +build !js,!wasm
+
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterTransport("direct", directTransport{})
+}
+
+// directTransport listens for peers on the port of Receive.DirectAddr, which
+// is put in the auth key as is instead of a STUN address. No external servers
+// are contacted, so senders must be able to reach us at it, e.g. on the same
+// network or through a port forward.
+type directTransport struct{}
+
+func (directTransport) Name() string { return "UDP" }
+
+func (directTransport) Listen(ctx context.Context, r *Receive) (ListenConn, <-chan struct{}, error) {
+	addr := r.DirectAddr
+	if !addr.Addr().Is4() || addr.Addr().IsUnspecified() || addr.Port() == 0 {
+		return nil, nil, fmt.Errorf("direct address %s must be an IPv4 address and port senders can reach", addr)
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(addr.Port())})
+	if err != nil {
+		return nil, nil, fmt.Errorf("listen direct: %w", err)
+	}
+
+	r.stunIP.Store(&addr)
+	ready := make(chan struct{})
+	close(ready)
+	return &udpListenConn{conn: conn}, ready, nil
+}
+
+// Dial never has anything to do, as auth keys can't tell the direct address
+// apart from a STUN address. Senders reach it over the stun transport.
+func (directTransport) Dial(context.Context, *Send) (DialConn, error) {
+	return nil, nil
+}
+
+// udpNetwork returns the network to listen on to reach addr.
+func udpNetwork(addr netip.AddrPort) string {
+	if addr.Addr().Is6() && !addr.Addr().Is4In6() {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// udpListenConn receives messages from senders on a UDP socket. Packets that
+// intercept, if set, returns true for aren't overlay messages, and are left
+// to it.
+type udpListenConn struct {
+	conn      *net.UDPConn
+	intercept func(buf []byte) bool
+}
+
+// Connect does nothing, as reads only fail for transient network errors. The
+// socket is kept, so its address in the auth key stays valid.
+func (uc *udpListenConn) Connect(context.Context) error {
+	return nil
+}
+
+func (uc *udpListenConn) Recv() (Frame, error) {
+	for {
+		buf := make([]byte, 4<<10)
+		n, addr, err := uc.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		buf = buf[:n]
+		if uc.intercept != nil && uc.intercept(buf) {
+			continue
+		}
+		return Frame{From: addr, Data: buf}, nil
+	}
+}
+
+func (uc *udpListenConn) SendTo(to PeerAddr, sealed []byte) error {
+	addr, ok := to.(netip.AddrPort)
+	if !ok {
+		return errors.New("UDP peers must be addressed by their address")
+	}
+	_, err := uc.conn.WriteToUDPAddrPort(sealed, addr)
+	return err
+}
+
+func (uc *udpListenConn) Close() error {
+	return uc.conn.Close()
+}
+
+// udpDialConn talks to the receiver over a UDP socket, at the address
+// returned by resolve. It is resolved again every time the overlay reconnects,
+// and stored in dest, where messages are sent to. The socket is kept across
+// reconnects, so the receiver still knows us by the same address.
+type udpDialConn struct {
+	conn    *net.UDPConn
+	resolve func(context.Context, *net.UDPConn) (netip.AddrPort, error)
+	dest    *atomic.Pointer[netip.AddrPort]
+}
+
+func newUDPDialConn(network string, dest *atomic.Pointer[netip.AddrPort], resolve func(context.Context, *net.UDPConn) (netip.AddrPort, error)) (*udpDialConn, error) {
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &udpDialConn{conn: conn, resolve: resolve, dest: dest}, nil
+}
+
+func (uc *udpDialConn) Connect(ctx context.Context) error {
+	addr, err := uc.resolve(ctx, uc.conn)
+	if err != nil {
+		return err
+	}
+	uc.dest.Store(&addr)
+	return nil
+}
+
+func (uc *udpDialConn) Recv() (Frame, error) {
+	for {
+		buf := make([]byte, 4<<10)
+		n, addr, err := uc.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		buf = buf[:n]
+		if isLANDiscovery(buf) {
+			// A late answer to our discovery broadcast.
+			continue
+		}
+		return Frame{From: addr, Data: buf}, nil
+	}
+}
+
+func (uc *udpDialConn) Send(sealed []byte) error {
+	_, err := uc.conn.WriteToUDPAddrPort(sealed, *uc.dest.Load())
+	return err
+}
+
+func (uc *udpDialConn) SetReadDeadline(t time.Time) error {
+	return uc.conn.SetReadDeadline(t)
+}
+
+func (uc *udpDialConn) Close() error {
+	return uc.conn.Close()
+}
@@ -4,7 +4,6 @@ package overlay
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -45,8 +44,9 @@ func NewWasmOverlay(hlog Logf, dm *tailcfg.DERPMap,
 		onWebrtcAnswer:    onWebrtcAnswer,
 		onWebrtcCandidate: onWebrtcCandidate,
 
-		in:  make(chan *tailcfg.Node, 8),
-		out: make(chan *overlayMessage, 8),
+		replay: xsync.NewMapOf[string, *replayWindow](),
+		in:     make(chan *tailcfg.Node, 8),
+		out:    make(chan *overlayMessage, 8),
 	}
 }
 
@@ -79,6 +79,11 @@ type Wasm struct {
 	onWebrtcAnswer    js.Value
 	onWebrtcCandidate js.Value
 
+	// seq stamps the messages we send, and replay holds the replay window of
+	// each peer, keyed by session ID or DERP key.
+	seq    messageSeq
+	replay *xsync.MapOf[string, *replayWindow]
+
 	lastNode atomic.Pointer[tailcfg.Node]
 	// in funnels node updates from other peers to us
 	in chan *tailcfg.Node
@@ -86,8 +91,14 @@ type Wasm struct {
 	out chan *overlayMessage
 }
 
-func (r *Wasm) IPs() []netip.Addr {
-	return []netip.Addr{r.SelfIP}
+func (r *Wasm) IPs(context.Context) ([]netip.Addr, error) {
+	return []netip.Addr{r.SelfIP}, nil
+}
+
+// AdmitDERP does nothing, as browsers only use relays without a shared
+// secret.
+func (r *Wasm) AdmitDERP(context.Context, key.NodePublic) error {
+	return nil
 }
 
 func (r *Wasm) PickDERPHome(ctx context.Context) error {
@@ -122,6 +133,7 @@ func (r *Wasm) ClientAuth() *ClientAuth {
 		OverlayPrivateKey:    r.PeerPriv,
 		ReceiverPublicKey:    r.SelfPriv.Public(),
 		ReceiverDERPRegionID: r.DerpRegionID,
+		Policy:               Policy{Scope: ScopeAll},
 	}
 }
 
@@ -129,6 +141,11 @@ func (r *Wasm) Recv() <-chan *tailcfg.Node {
 	return r.in
 }
 
+// Removed never fires, as peers aren't tracked in the browser yet.
+func (r *Wasm) Removed() <-chan key.NodePublic {
+	return nil
+}
+
 func (r *Wasm) SendTailscaleNodeUpdate(node *tailcfg.Node) {
 	r.out <- &overlayMessage{
 		Typ:  messageTypeNodeUpdate,
@@ -189,12 +206,7 @@ func (r *Wasm) Connect(ctx context.Context, ca ClientAuth, offer webrtc.SessionD
 					return
 				}
 
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal overlay msg: " + err.Error())
-				}
-
-				sealed := ca.OverlayPrivateKey.SealTo(ca.ReceiverPublicKey, raw)
+				sealed := ca.OverlayPrivateKey.SealTo(ca.ReceiverPublicKey, r.seq.marshal(*msg))
 				err = c.Send(ca.ReceiverPublicKey, sealed)
 				if err != nil {
 					fmt.Println("send response over derp:", err)
@@ -209,6 +221,8 @@ func (r *Wasm) Connect(ctx context.Context, ca ClientAuth, offer webrtc.SessionD
 	closeOnce := sync.Once{}
 	helloResp := overlayMessage{}
 	helloSrc := key.NodePublic{}
+	// helloErr is set if the peer refused to talk to us.
+	var helloErr error
 
 	go func() {
 		for {
@@ -226,6 +240,13 @@ func (r *Wasm) Connect(ctx context.Context, ca ClientAuth, offer webrtc.SessionD
 				}
 
 				res, _, ovmsg, err := r.handleNextMessage(msg.Source, ca.OverlayPrivateKey, ca.ReceiverPublicKey, msg.Data)
+				if errors.Is(err, ErrIncompatible) {
+					helloErr = err
+					closeOnce.Do(func() {
+						close(waitHello)
+					})
+					return
+				}
 				if err != nil {
 					fmt.Println("Failed to handle overlay message:", err)
 					continue
@@ -255,6 +276,10 @@ func (r *Wasm) Connect(ctx context.Context, ca ClientAuth, offer webrtc.SessionD
 		c.Close()
 		return Peer{}, errors.New("timed out waiting for peer to respond")
 	case <-waitHello:
+		if helloErr != nil {
+			c.Close()
+			return Peer{}, helloErr
+		}
 		updates <- &overlayMessage{
 			Typ:  messageTypeNodeUpdate,
 			Node: *r.lastNode.Load(),
@@ -300,12 +325,7 @@ func (r *Wasm) ListenOverlayDERP(ctx context.Context) error {
 				if msg.Typ == messageTypeNodeUpdate {
 					r.lastNode.Store(&msg.Node)
 				}
-				raw, err := json.Marshal(msg)
-				if err != nil {
-					panic("marshal overlay msg: " + err.Error())
-				}
-
-				sealed := r.SelfPriv.SealTo(r.PeerPriv.Public(), raw)
+				sealed := r.SelfPriv.SealTo(r.PeerPriv.Public(), r.seq.marshal(*msg))
 				// range over peers that have connected to us
 				peers.Range(func(_, derpKey key.NodePublic) bool {
 					fmt.Println("sending node to inbound peer")
@@ -360,7 +380,7 @@ func (r *Wasm) newHelloPacket(ca ClientAuth, offer webrtc.SessionDescription) []
 		hostname string = "wush.dev"
 	)
 
-	raw, err := json.Marshal(overlayMessage{
+	raw := r.seq.marshal(overlayMessage{
 		Typ: messageTypeHello,
 		HostInfo: HostInfo{
 			Username: username,
@@ -368,10 +388,7 @@ func (r *Wasm) newHelloPacket(ca ClientAuth, offer webrtc.SessionDescription) []
 		},
 		Node:              *r.lastNode.Load(),
 		WebrtcDescription: &offer,
-	})
-	if err != nil {
-		panic("marshal node: " + err.Error())
-	}
+	}.withProtocol(nil))
 
 	sealed := ca.OverlayPrivateKey.SealTo(ca.ReceiverPublicKey, raw)
 	return sealed
@@ -383,12 +400,21 @@ func (r *Wasm) handleNextMessage(derpPub key.NodePublic, selfPriv key.NodePrivat
 		return nil, key.NodePublic{}, overlayMessage{}, errors.New("message failed decryption")
 	}
 
-	var ovMsg overlayMessage
 	fmt.Println(string(cleartext))
-	err := json.Unmarshal(cleartext, &ovMsg)
+	ovMsg, err := decodeOverlayMessage(cleartext)
 	if err != nil {
-		fmt.Printf("Unmarshal error: %#v\n", err)
-		panic("unmarshal node: " + err.Error())
+		return nil, key.NodePublic{}, overlayMessage{}, err
+	}
+	stream := ovMsg.SessionID
+	if stream == "" {
+		stream = derpPub.String()
+	}
+	window, _ := r.replay.LoadOrCompute(stream, func() *replayWindow {
+		return &replayWindow{}
+	})
+	err = window.check(ovMsg, time.Now())
+	if err != nil {
+		return nil, key.NodePublic{}, overlayMessage{}, err
 	}
 
 	res := overlayMessage{}
@@ -398,7 +424,12 @@ func (r *Wasm) handleNextMessage(derpPub key.NodePublic, selfPriv key.NodePrivat
 	case messageTypePong:
 		// do nothing
 	case messageTypeHello:
-		res.Typ = messageTypeHelloResponse
+		if err := checkProtocol(ovMsg); err != nil {
+			r.HumanLogf("%s Rejected connection request from %s: %s", cliui.Timestamp(time.Now()), cliui.Keyword(ovMsg.HostInfo.String()), err)
+			res = overlayMessage{Typ: messageTypeHelloIncompatible}.withProtocol(nil)
+			break
+		}
+		res = overlayMessage{Typ: messageTypeHelloResponse}.withProtocol(nil)
 		res.HostInfo.Username = r.username
 		res.HostInfo.Hostname = "wush.dev"
 		username := "unknown"
@@ -428,7 +459,11 @@ func (r *Wasm) handleNextMessage(derpPub key.NodePublic, selfPriv key.NodePrivat
 		}
 
 	case messageTypeHelloResponse:
+		if err := checkProtocol(ovMsg); err != nil {
+			return nil, key.NodePublic{}, ovMsg, err
+		}
 		if !ovMsg.Node.Key.IsZero() {
+			nameNode(&ovMsg.Node, ovMsg.HostInfo)
 			r.in <- &ovMsg.Node
 		}
 
@@ -439,6 +474,13 @@ func (r *Wasm) handleNextMessage(derpPub key.NodePublic, selfPriv key.NodePrivat
 			})
 		}
 
+	case messageTypeHelloIncompatible:
+		err := checkProtocol(ovMsg)
+		if err == nil {
+			err = ErrIncompatible
+		}
+		return nil, key.NodePublic{}, ovMsg, err
+
 	case messageTypeNodeUpdate:
 		r.HumanLogf("%s Received updated node from %s", cliui.Timestamp(time.Now()), cliui.Code(ovMsg.Node.Key.String()))
 		if !ovMsg.Node.Key.IsZero() {
@@ -446,16 +488,25 @@ func (r *Wasm) handleNextMessage(derpPub key.NodePublic, selfPriv key.NodePrivat
 		}
 
 	case messageTypeWebRTCOffer:
+		if ovMsg.WebrtcDescription == nil {
+			return nil, key.NodePublic{}, ovMsg, errors.New("webrtc offer message is missing the description")
+		}
 		res.Typ = messageTypeWebRTCAnswer
 		r.handleWebrtcOffer(derpPub, &res, *ovMsg.WebrtcDescription)
 
 	case messageTypeWebRTCAnswer:
+		if ovMsg.WebrtcDescription == nil {
+			return nil, key.NodePublic{}, ovMsg, errors.New("webrtc answer message is missing the description")
+		}
 		r.onWebrtcAnswer.Invoke(js.ValueOf(derpPub.String()), js.ValueOf(map[string]any{
 			"type": js.ValueOf(ovMsg.WebrtcDescription.Type.String()),
 			"sdp":  js.ValueOf(ovMsg.WebrtcDescription.SDP),
 		}))
 
 	case messageTypeWebRTCCandidate:
+		if ovMsg.WebrtcCandidate == nil {
+			return nil, key.NodePublic{}, ovMsg, errors.New("webrtc candidate message is missing the candidate")
+		}
 		cand := map[string]any{
 			"candidate": js.ValueOf(ovMsg.WebrtcCandidate.Candidate),
 		}
@@ -471,18 +522,16 @@ func (r *Wasm) handleNextMessage(derpPub key.NodePublic, selfPriv key.NodePrivat
 
 		r.onWebrtcCandidate.Invoke(derpPub.String(), cand)
 
+	default:
+		// Likely from a newer peer, which must not rely on us understanding it.
+		fmt.Println("ignoring unsupported overlay message:", ovMsg.Typ)
 	}
 
 	if res.Typ == 0 {
 		return nil, ovMsg.Node.Key, ovMsg, nil
 	}
 
-	raw, err := json.Marshal(res)
-	if err != nil {
-		panic("marshal node: " + err.Error())
-	}
-
-	sealed := selfPriv.SealTo(peerPub, raw)
+	sealed := selfPriv.SealTo(peerPub, r.seq.marshal(res))
 	return sealed, ovMsg.Node.Key, ovMsg, nil
 }
 
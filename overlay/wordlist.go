@@ -0,0 +1,41 @@
+package overlay
+
+// pairingWords is the list of words used in pairing codes. Each word encodes 8
+// bits of the code's password.
+var pairingWords = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alley",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "armor", "arrow",
+	"aspen", "atlas", "attic", "award", "bacon", "badge", "bagel", "baker",
+	"bamboo", "banjo", "barn", "basil", "basin", "beach", "beacon", "beard",
+	"beaver", "berry", "bison", "blade", "blanket", "blossom", "bobcat",
+	"bonus", "border", "bottle", "branch", "brave", "breeze", "brick", "bridge",
+	"bronze", "brook", "bubble", "bucket", "buffalo", "bugle", "bundle",
+	"burrow", "butter", "cabin", "cactus", "camel", "candle", "canoe", "canyon",
+	"carbon", "carpet", "castle", "cedar", "chalk", "cherry", "chess",
+	"chimney", "cider", "circus", "citrus", "clover", "cobalt", "cocoa",
+	"comet", "copper", "coral", "cotton", "cougar", "crater", "cricket",
+	"crystal", "cupcake", "daisy", "dancer", "delta", "denim", "desert",
+	"dolphin", "donkey", "dragon", "dynamo", "eagle", "easel", "echo",
+	"eclipse", "elbow", "ember", "engine", "falcon", "fender", "ferry",
+	"fiddle", "finch", "flamingo", "flute", "forest", "fossil", "fountain",
+	"fox", "galaxy", "garden", "garlic", "gecko", "ginger", "glacier", "gopher",
+	"granite", "grape", "gravel", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "helmet", "heron", "hickory", "hippo", "hollow", "honey", "hornet",
+	"husky", "igloo", "indigo", "island", "ivory", "jacket", "jaguar",
+	"jasmine", "jelly", "jigsaw", "jungle", "kayak", "kettle", "kiwi", "koala",
+	"ladder", "lagoon", "lantern", "lemon", "lettuce", "lilac", "lobster",
+	"locket", "lotus", "magnet", "mango", "maple", "marble", "meadow", "melon",
+	"meteor", "mitten", "monkey", "mosaic", "muffin", "nectar", "needle",
+	"nickel", "noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "orbit",
+	"orchid", "otter", "oyster", "paddle", "panda", "papaya", "parrot",
+	"peanut", "pebble", "pelican", "pepper", "pickle", "pigeon", "pillow",
+	"pilot", "pine", "planet", "plum", "pocket", "pony", "poppy", "potato",
+	"prairie", "pretzel", "pumpkin", "puppet", "purple", "quartz", "quill",
+	"rabbit", "radar", "radish", "raven", "ribbon", "river", "robin", "rocket",
+	"saddle", "salmon", "sausage", "shadow", "sierra", "silver", "sparrow",
+	"spider", "spruce", "squid", "statue", "summit", "sunset", "tango",
+	"teapot", "thistle", "thunder", "tiger", "timber", "toast", "tomato",
+	"tractor", "trumpet", "tulip", "tundra", "turtle", "umbrella", "valley",
+	"velvet", "violet", "volcano", "waffle", "walnut", "walrus", "willow",
+	"window", "wizard", "yogurt", "zebra", "zephyr",
+}
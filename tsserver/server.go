@@ -34,11 +34,15 @@ import (
 	"tailscale.com/control/controlbase"
 	"tailscale.com/control/controlhttp/controlhttpserver"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/smallzstd"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/dnstype"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/opt"
 	"tailscale.com/types/ptr"
+	"tailscale.com/util/dnsname"
 
 	"github.com/coder/wush/overlay"
 )
@@ -64,6 +68,10 @@ func DERPMapTailscale(ctx context.Context) (*tailcfg.DERPMap, error) {
 	return dm, nil
 }
 
+// MagicDNSSuffix is the domain of the MagicDNS names given to nodes, e.g.
+// alice-laptop.wush.internal.
+const MagicDNSSuffix = "wush.internal"
+
 func NewServer(ctx context.Context, logger *slog.Logger, ov overlay.Overlay, dm *tailcfg.DERPMap) (*server, error) {
 	s := &server{
 		logger:          logger,
@@ -74,8 +82,10 @@ func NewServer(ctx context.Context, logger *slog.Logger, ov overlay.Overlay, dm
 		overlay:         ov,
 		derpMap:         dm,
 
-		peerMap:       xsync.NewMapOf[key.NodePublic, *tailcfg.Node](),
-		peerMapUpdate: make(chan update, 8),
+		packetFilter: tailcfg.FilterAllowAll,
+		peerMap:      xsync.NewMapOf[key.NodePublic, *tailcfg.Node](),
+		peerSubs:     map[chan struct{}]struct{}{},
+		peerNames:    map[tailcfg.NodeID]string{},
 	}
 
 	return s, nil
@@ -90,11 +100,99 @@ type server struct {
 
 	overlay overlay.Overlay
 
-	node       atomic.Pointer[tailcfg.Node]
-	nodeUpdate chan struct{}
+	node         atomic.Pointer[tailcfg.Node]
+	nodeUpdate   chan struct{}
+	packetFilter []tailcfg.FilterRule
+	// routes are the subnet and exit routes the node may advertise.
+	routes []netip.Prefix
+	// routeFilter returns the rules for reaching routes, given the peers.
+	routeFilter func(peers []*tailcfg.Node) []tailcfg.FilterRule
+
+	// peerMap is the netmap's peers, keyed by node key. Streaming map
+	// requests are told when it changes through peerSubs, and send the
+	// difference to what they last sent.
+	peerMap    *xsync.MapOf[key.NodePublic, *tailcfg.Node]
+	peerSubsMu sync.Mutex
+	peerSubs   map[chan struct{}]struct{}
+	// peerNames are the MagicDNS labels given to peers. They're only used
+	// by ListenAndServe.
+	peerNames map[tailcfg.NodeID]string
+}
+
+// SetNoiseKey sets the private key the server identifies itself to the node
+// with, so that it can be kept across restarts along with the node's state. By
+// default a new one is generated. It must be called before ListenAndServe.
+func (s *server) SetNoiseKey(k key.MachinePrivate) {
+	s.noisePrivateKey = k
+}
+
+// SetPacketFilter sets the rules for what peers can send to the node. By
+// default they can reach anything. It must be called before ListenAndServe.
+func (s *server) SetPacketFilter(rules []tailcfg.FilterRule) {
+	if rules == nil {
+		rules = []tailcfg.FilterRule{}
+	}
+	s.packetFilter = rules
+}
 
-	peerMap       *xsync.MapOf[key.NodePublic, *tailcfg.Node]
-	peerMapUpdate chan update
+// SetRoutes approves routes, so that the node can advertise them to its peers
+// as a subnet router or, with the exit routes, as an exit node. Routes the node
+// advertises that aren't approved are ignored. It must be called before
+// ListenAndServe.
+func (s *server) SetRoutes(routes []netip.Prefix) {
+	s.routes = routes
+}
+
+// SetRouteFilter sets how the packet filter rules for reaching routes are
+// derived from the peers. They're sent again whenever the peers change, so
+// that only some of them can be allowed. It must be called before
+// ListenAndServe.
+func (s *server) SetRouteFilter(filter func(peers []*tailcfg.Node) []tailcfg.FilterRule) {
+	s.routeFilter = filter
+}
+
+// FilterAllowRoutes returns packet filter rules that let srcs open TCP
+// connections to the routes through the node. With ports, only those ports are
+// allowed.
+func FilterAllowRoutes(routes []netip.Prefix, srcs []netip.Addr, ports ...tailcfg.PortRange) []tailcfg.FilterRule {
+	if len(routes) == 0 || len(srcs) == 0 {
+		return []tailcfg.FilterRule{}
+	}
+	if len(ports) == 0 {
+		ports = []tailcfg.PortRange{tailcfg.PortRangeAny}
+	}
+
+	rule := tailcfg.FilterRule{IPProto: []int{int(ipproto.TCP)}}
+	for _, src := range srcs {
+		rule.SrcIPs = append(rule.SrcIPs, src.String())
+	}
+	for _, route := range routes {
+		for _, pr := range ports {
+			rule.DstPorts = append(rule.DstPorts, tailcfg.NetPortRange{IP: route.String(), Ports: pr})
+		}
+	}
+	return []tailcfg.FilterRule{rule}
+}
+
+// FilterAllowTCPPorts returns packet filter rules that only let peers open TCP
+// connections to ports on dsts, the node's own addresses. With no ports, peers
+// can't reach the node at all, though it can still connect to them. Routes the
+// node advertises are left to FilterAllowRoutes.
+func FilterAllowTCPPorts(dsts []netip.Addr, ports ...tailcfg.PortRange) []tailcfg.FilterRule {
+	if len(dsts) == 0 || len(ports) == 0 {
+		return []tailcfg.FilterRule{}
+	}
+
+	rule := tailcfg.FilterRule{
+		SrcIPs:  []string{"*"},
+		IPProto: []int{int(ipproto.TCP)},
+	}
+	for _, dst := range dsts {
+		for _, pr := range ports {
+			rule.DstPorts = append(rule.DstPorts, tailcfg.NetPortRange{IP: dst.String(), Ports: pr})
+		}
+	}
+	return []tailcfg.FilterRule{rule}
 }
 
 func (s *server) ListenAndServe(_ context.Context) error {
@@ -111,11 +209,15 @@ func (s *server) ListenAndServe(_ context.Context) error {
 		for {
 			select {
 			case node := <-s.overlay.Recv():
-				s.peerMap.Store(node.Key, node)
-				s.peerMapUpdate <- update{
-					ty:   updateTypeNewPeer,
-					node: node,
+				s.storePeer(node)
+				s.notifyPeers()
+			case nodeKey := <-s.overlay.Removed():
+				node, ok := s.peerMap.LoadAndDelete(nodeKey)
+				if !ok {
+					continue
 				}
+				delete(s.peerNames, node.ID)
+				s.notifyPeers()
 			case <-s.nodeUpdate:
 				s.overlay.SendTailscaleNodeUpdate(s.node.Load())
 			}
@@ -125,6 +227,101 @@ func (s *server) ListenAndServe(_ context.Context) error {
 	return http.Serve(s.ml, r)
 }
 
+// storePeer adds node to the netmap, or replaces it if it's already there. A
+// peer that re-registered keeps its node ID under a new node key, in which case
+// its old key is dropped, so the two don't share an ID.
+func (s *server) storePeer(node *tailcfg.Node) {
+	node = node.Clone()
+	node.Name = s.peerName(node)
+	s.peerMap.Range(func(nodeKey key.NodePublic, peer *tailcfg.Node) bool {
+		if peer.ID == node.ID && nodeKey != node.Key {
+			s.peerMap.Delete(nodeKey)
+		}
+		return true
+	})
+	s.peerMap.Store(node.Key, node)
+}
+
+// peerName returns the MagicDNS name of node. It's derived from the name the
+// overlay gave the node when the peer is first seen, and kept for as long as
+// it's in the netmap. Peers with the same name are told apart by a number.
+func (s *server) peerName(node *tailcfg.Node) string {
+	label, ok := s.peerNames[node.ID]
+	if !ok {
+		base := dnsLabel(node.Name)
+		label = base
+		for i := 2; s.nameTaken(label); i++ {
+			label = fmt.Sprintf("%s-%d", base, i)
+		}
+		s.peerNames[node.ID] = label
+	}
+	return label + "." + MagicDNSSuffix + "."
+}
+
+// nameTaken reports whether label is the MagicDNS label of the node or one of
+// its peers.
+func (s *server) nameTaken(label string) bool {
+	if self := s.node.Load(); self != nil && dnsname.FirstLabel(self.Name) == label {
+		return true
+	}
+	for _, taken := range s.peerNames {
+		if taken == label {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsLabel turns the name of a node into a DNS label.
+func dnsLabel(name string) string {
+	label := dnsname.SanitizeHostname(dnsname.FirstLabel(name))
+	if label == "" {
+		return "peer"
+	}
+	return label
+}
+
+// peers returns the peers in the netmap, sorted by node ID. They must not be
+// modified.
+func (s *server) peers() []*tailcfg.Node {
+	peers := []*tailcfg.Node{}
+	s.peerMap.Range(func(_ key.NodePublic, node *tailcfg.Node) bool {
+		peers = append(peers, node)
+		return true
+	})
+	xslices.SortFunc(peers, func(a, b *tailcfg.Node) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return peers
+}
+
+// subscribePeers returns a channel that receives whenever the peers change,
+// until unsubscribe is called. Changes that happen while a previous one hasn't
+// been received yet are coalesced.
+func (s *server) subscribePeers() (_ <-chan struct{}, unsubscribe func()) {
+	ch := make(chan struct{}, 1)
+	s.peerSubsMu.Lock()
+	s.peerSubs[ch] = struct{}{}
+	s.peerSubsMu.Unlock()
+
+	return ch, func() {
+		s.peerSubsMu.Lock()
+		delete(s.peerSubs, ch)
+		s.peerSubsMu.Unlock()
+	}
+}
+
+func (s *server) notifyPeers() {
+	s.peerSubsMu.Lock()
+	defer s.peerSubsMu.Unlock()
+	for ch := range s.peerSubs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
 type memListen struct {
 	listen chan net.Conn
 }
@@ -236,14 +433,18 @@ func (s *server) KeyHandler(
 func (s *server) NoiseUpgradeHandler(w http.ResponseWriter, r *http.Request) {
 	s.logger.Info("got noise upgrade request")
 	ns := noiseServer{
-		logger:     s.logger,
-		derpMap:    s.derpMap,
-		challenge:  key.NewChallenge(),
-		peers:      xsync.NewMapOf[tailcfg.NodeID, *tailcfg.Node](),
-		peerUpdate: s.peerMapUpdate,
-		node:       &s.node,
-		nodeUpdate: s.nodeUpdate,
-		getIPs:     s.overlay.IPs,
+		logger:         s.logger,
+		derpMap:        s.derpMap,
+		challenge:      key.NewChallenge(),
+		getPeers:       s.peers,
+		subscribePeers: s.subscribePeers,
+		node:           &s.node,
+		nodeUpdate:     s.nodeUpdate,
+		packetFilter:   s.packetFilter,
+		routes:         s.routes,
+		routeFilter:    s.routeFilter,
+		getIPs:         s.overlay.IPs,
+		admitDERP:      s.overlay.AdmitDERP,
 	}
 
 	noiseConn, err := controlhttpserver.AcceptHTTP(
@@ -306,20 +507,6 @@ func (s *server) NoiseUpgradeHandler(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
-type updateType int
-
-const (
-	updateTypeNewPeer updateType = iota
-	updateTypePeerUpdate
-)
-
-type update struct {
-	ty updateType
-
-	node   *tailcfg.Node
-	update *tailcfg.PeerChange
-}
-
 type noiseServer struct {
 	logger         *slog.Logger
 	httpBaseConfig *http.Server
@@ -327,13 +514,17 @@ type noiseServer struct {
 	conn           *controlbase.Conn
 	machineKey     key.MachinePublic
 	derpMap        *tailcfg.DERPMap
-	getIPs         func() []netip.Addr
+	getIPs         func(ctx context.Context) ([]netip.Addr, error)
+	admitDERP      func(ctx context.Context, nodeKey key.NodePublic) error
 
-	peers      *xsync.MapOf[tailcfg.NodeID, *tailcfg.Node]
-	peerUpdate chan update
+	getPeers       func() []*tailcfg.Node
+	subscribePeers func() (_ <-chan struct{}, unsubscribe func())
 
-	node       *atomic.Pointer[tailcfg.Node]
-	nodeUpdate chan struct{}
+	node         *atomic.Pointer[tailcfg.Node]
+	nodeUpdate   chan struct{}
+	packetFilter []tailcfg.FilterRule
+	routes       []netip.Prefix
+	routeFilter  func(peers []*tailcfg.Node) []tailcfg.FilterRule
 
 	// EarlyNoise-related stuff
 	challenge       key.ChallengePrivate
@@ -356,7 +547,12 @@ func (ns *noiseServer) NoiseRegistrationHandler(w http.ResponseWriter, r *http.R
 
 	sp := strings.SplitN(registerRequest.Auth.AuthKey, "-", 2)
 
-	ips := ns.getIPs()
+	ips, err := ns.getIPs(r.Context())
+	if err != nil {
+		ns.logger.Error("failed to get node IPs", "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	resp := tailcfg.RegisterResponse{}
 	resp.MachineAuthorized = true
@@ -387,17 +583,29 @@ func (ns *noiseServer) NoiseRegistrationHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	// The node connects to DERP once it gets a netmap, so it must be admitted
+	// first. If it can't be, it can still connect directly.
+	err = ns.admitDERP(r.Context(), registerRequest.NodeKey)
+	if err != nil {
+		ns.logger.Error("failed to admit node to DERP", "err", err)
+	}
+
+	// Peers know a node that re-registers, e.g. to rotate its node key, by
+	// its ID, so it's kept.
 	nodeID := tailcfg.NodeID(rand.Int64())
+	if self := ns.getSelfNode(); self != nil {
+		nodeID = self.ID
+	}
 	addrs := []netip.Prefix{}
 	for _, ip := range ips {
 		addrs = append(addrs, netip.PrefixFrom(ip, ip.BitLen()))
 	}
 
-	ns.storeNode(&tailcfg.Node{
+	node := &tailcfg.Node{
 		ID:         nodeID,
 		StableID:   tailcfg.StableNodeID(sp[0]),
 		Hostinfo:   registerRequest.Hostinfo.View(),
-		Name:       registerRequest.Hostinfo.Hostname,
+		Name:       dnsLabel(registerRequest.Hostinfo.Hostname) + "." + MagicDNSSuffix + ".",
 		User:       resp.User.ID,
 		Machine:    ns.machineKey,
 		Key:        registerRequest.NodeKey,
@@ -410,7 +618,9 @@ func (ns *noiseServer) NoiseRegistrationHandler(w http.ResponseWriter, r *http.R
 			tailcfg.CapabilityDebug: []tailcfg.RawMessage{"true"},
 		},
 		MachineAuthorized: true,
-	})
+	}
+	ns.applyRoutes(node)
+	ns.storeNode(node)
 
 	ns.logger.Info("notify update")
 	ns.notifyUpdate()
@@ -475,18 +685,27 @@ func (ns *noiseServer) NoisePollNetMapHandler(
 
 }
 
-func (ns *noiseServer) peerMap() []*tailcfg.Node {
-	peers := []*tailcfg.Node{}
-
-	ns.peers.Range(func(key tailcfg.NodeID, value *tailcfg.Node) bool {
-		peers = append(peers, value.Clone())
-		return true
-	})
-	xslices.SortFunc(peers, func(a, b *tailcfg.Node) int {
-		return cmp.Compare(a.ID, b.ID)
-	})
-
-	return peers
+// peersDelta returns the peers that were added or changed since sent, and the
+// IDs of those that were removed, updating sent to the current peers.
+func (ns *noiseServer) peersDelta(sent map[tailcfg.NodeID]*tailcfg.Node) (changed []*tailcfg.Node, removed []tailcfg.NodeID) {
+	peers := ns.getPeers()
+	current := make(map[tailcfg.NodeID]struct{}, len(peers))
+	for _, peer := range peers {
+		current[peer.ID] = struct{}{}
+		// Peers are replaced, not modified, when they change.
+		if sent[peer.ID] != peer {
+			changed = append(changed, peer.Clone())
+			sent[peer.ID] = peer
+		}
+	}
+	for id := range sent {
+		if _, ok := current[id]; !ok {
+			removed = append(removed, id)
+			delete(sent, id)
+		}
+	}
+	xslices.Sort(removed)
+	return changed, removed
 }
 
 func (ns *noiseServer) handleStreaming(ctx context.Context, w http.ResponseWriter, req *tailcfg.MapRequest) {
@@ -500,6 +719,12 @@ func (ns *noiseServer) handleStreaming(ctx context.Context, w http.ResponseWrite
 	keepAlive := time.NewTicker(50 * time.Second)
 	defer keepAlive.Stop()
 
+	// Subscribe before the first response, so no change is missed.
+	peersChanged, unsubscribe := ns.subscribePeers()
+	defer unsubscribe()
+	sent := map[tailcfg.NodeID]*tailcfg.Node{}
+	peers, _ := ns.peersDelta(sent)
+
 	res := &tailcfg.MapResponse{
 		KeepAlive:       false,
 		ControlTime:     ptr.To(time.Now()),
@@ -509,8 +734,11 @@ func (ns *noiseServer) handleStreaming(ctx context.Context, w http.ResponseWrite
 		Debug: &tailcfg.Debug{
 			DisableLogTail: true,
 		},
-		Peers:        ns.peerMap(),
-		PacketFilter: tailcfg.FilterAllowAll,
+		Peers:     peers,
+		DNSConfig: dnsConfig(peers),
+		// An empty PacketFilter would be omitted, which means it's
+		// unchanged, rather than that nothing is allowed.
+		PacketFilters: ns.packetFilters(true),
 	}
 
 	err := writeMapResponse(w, req, res)
@@ -528,16 +756,21 @@ func (ns *noiseServer) handleStreaming(ctx context.Context, w http.ResponseWrite
 		select {
 		case <-ctx.Done():
 			return
-		case upd := <-ns.peerUpdate:
-			res := &tailcfg.MapResponse{
-				KeepAlive:   false,
-				ControlTime: ptr.To(time.Now()),
+		case <-peersChanged:
+			changed, removed := ns.peersDelta(sent)
+			if len(changed) == 0 && len(removed) == 0 {
+				continue
 			}
-			if upd.ty == updateTypeNewPeer {
-				ns.peers.Store(upd.node.ID, upd.node.Clone())
-				res.Peers = ns.peerMap()
-			} else if upd.ty == updateTypePeerUpdate {
-				res.PeersChangedPatch = []*tailcfg.PeerChange{upd.update}
+			// Only what changed is sent, rather than all peers, which also
+			// lets the last peer be removed, as an empty Peers is omitted.
+			res := &tailcfg.MapResponse{
+				KeepAlive:    false,
+				ControlTime:  ptr.To(time.Now()),
+				PeersChanged: changed,
+				PeersRemoved: removed,
+				DNSConfig:    dnsConfig(ns.getPeers()),
+				// Which peers may use routes depends on the peers.
+				PacketFilters: ns.packetFilters(false),
 			}
 
 			err := writeMapResponse(w, req, res)
@@ -569,6 +802,58 @@ func (ns *noiseServer) handleStreaming(ctx context.Context, w http.ResponseWrite
 	}
 }
 
+// dnsConfig returns the MagicDNS config that lets peers be reached by their
+// names. Names under MagicDNSSuffix are resolved by the node itself, from a
+// record for each address of each peer.
+func dnsConfig(peers []*tailcfg.Node) *tailcfg.DNSConfig {
+	cfg := &tailcfg.DNSConfig{
+		Proxied: true,
+		Domains: []string{MagicDNSSuffix},
+		Routes: map[string][]*dnstype.Resolver{
+			// An empty list of resolvers means the node answers itself.
+			MagicDNSSuffix: {},
+		},
+	}
+	for _, peer := range peers {
+		for _, addr := range peer.Addresses {
+			if !addr.IsSingleIP() {
+				continue
+			}
+			typ := "A"
+			if addr.Addr().Is6() {
+				typ = "AAAA"
+			}
+			cfg.ExtraRecords = append(cfg.ExtraRecords, tailcfg.DNSRecord{
+				Name:  peer.Name,
+				Type:  typ,
+				Value: addr.Addr().String(),
+			})
+		}
+	}
+	return cfg
+}
+
+// packetFilters returns the named packet filters to send, which are only the
+// ones that depend on the peers unless all is set. Filters that aren't sent are
+// left unchanged.
+func (ns *noiseServer) packetFilters(all bool) map[string][]tailcfg.FilterRule {
+	filters := map[string][]tailcfg.FilterRule{}
+	if all {
+		filters["base"] = ns.packetFilter
+	}
+	if ns.routeFilter != nil {
+		rules := ns.routeFilter(ns.getPeers())
+		if rules == nil {
+			rules = []tailcfg.FilterRule{}
+		}
+		filters["routes"] = rules
+	}
+	if len(filters) == 0 {
+		return nil
+	}
+	return filters
+}
+
 func writeMapResponse(w http.ResponseWriter, req *tailcfg.MapRequest, res *tailcfg.MapResponse) error {
 	jsonBody, err := json.Marshal(res)
 	if err != nil {
@@ -629,7 +914,9 @@ func (ns *noiseServer) handleEndpointUpdate(_ http.ResponseWriter, req *tailcfg.
 
 	sendUpdate, routesChanged := hostInfoChanged(node.Hostinfo.AsStruct(), req.Hostinfo)
 	node.Hostinfo = req.Hostinfo.View()
-	_ = routesChanged
+	if routesChanged {
+		ns.applyRoutes(node)
+	}
 
 	if peerChangeEmpty(change) && !sendUpdate {
 		return
@@ -638,6 +925,24 @@ func (ns *noiseServer) handleEndpointUpdate(_ http.ResponseWriter, req *tailcfg.
 	ns.notifyUpdate()
 }
 
+// applyRoutes routes the approved routes that the node advertises in its
+// Hostinfo to it. Exit routes are allowed, but aren't primary routes, as
+// peers only use them once they pick the node as their exit node.
+func (ns *noiseServer) applyRoutes(node *tailcfg.Node) {
+	routes := []netip.Prefix{}
+	if node.Hostinfo.Valid() {
+		for _, route := range node.Hostinfo.RoutableIPs().All() {
+			if xslices.Contains(ns.routes, route) {
+				routes = append(routes, route)
+			}
+		}
+	}
+	tsaddr.SortPrefixes(routes)
+
+	node.AllowedIPs = append(xslices.Clone(node.Addresses), routes...)
+	node.PrimaryRoutes = xslices.DeleteFunc(routes, tsaddr.IsExitRoute)
+}
+
 func applyPeerChange(node *tailcfg.Node, change tailcfg.PeerChange) {
 	if change.Key != nil {
 		node.Key = *change.Key
@@ -0,0 +1,182 @@
+package tsserver
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/puzpuzpuz/xsync/v3"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/types/key"
+)
+
+func TestPeersDelta(t *testing.T) {
+	node := func(id tailcfg.NodeID) *tailcfg.Node {
+		return &tailcfg.Node{ID: id, Key: key.NewNode().Public()}
+	}
+	a, b, c := node(1), node(2), node(3)
+	a2 := a.Clone()
+	a2.Endpoints = []netip.AddrPort{netip.MustParseAddrPort("203.0.113.7:41641")}
+
+	var peers []*tailcfg.Node
+	ns := &noiseServer{getPeers: func() []*tailcfg.Node { return peers }}
+	sent := map[tailcfg.NodeID]*tailcfg.Node{}
+
+	for _, tc := range []struct {
+		name        string
+		peers       []*tailcfg.Node
+		wantChanged []tailcfg.NodeID
+		wantRemoved []tailcfg.NodeID
+	}{
+		{name: "Initial", peers: []*tailcfg.Node{a, b}, wantChanged: []tailcfg.NodeID{1, 2}},
+		{name: "Unchanged", peers: []*tailcfg.Node{a, b}},
+		{name: "Added", peers: []*tailcfg.Node{a, b, c}, wantChanged: []tailcfg.NodeID{3}},
+		{name: "Changed", peers: []*tailcfg.Node{a2, b, c}, wantChanged: []tailcfg.NodeID{1}},
+		{name: "Removed", peers: []*tailcfg.Node{a2, c}, wantRemoved: []tailcfg.NodeID{2}},
+		{name: "RemovedLast", peers: nil, wantRemoved: []tailcfg.NodeID{1, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			peers = tc.peers
+			changed, removed := ns.peersDelta(sent)
+
+			var changedIDs []tailcfg.NodeID
+			for _, peer := range changed {
+				changedIDs = append(changedIDs, peer.ID)
+			}
+			if !reflect.DeepEqual(changedIDs, tc.wantChanged) {
+				t.Errorf("got changed peers %v, want %v", changedIDs, tc.wantChanged)
+			}
+			if !reflect.DeepEqual(removed, tc.wantRemoved) {
+				t.Errorf("got removed peers %v, want %v", removed, tc.wantRemoved)
+			}
+			if len(sent) != len(tc.peers) {
+				t.Errorf("sent tracks %d peers, want %d", len(sent), len(tc.peers))
+			}
+		})
+	}
+}
+
+func TestFilterAllowTCPPorts(t *testing.T) {
+	self := netip.MustParseAddr("fd7a:115c:a1e0::1")
+	ssh := tailcfg.PortRange{First: 3, Last: 3}
+
+	for _, tc := range []struct {
+		name  string
+		dsts  []netip.Addr
+		ports []tailcfg.PortRange
+		want  []tailcfg.FilterRule
+	}{
+		{name: "NoPorts", dsts: []netip.Addr{self}, want: []tailcfg.FilterRule{}},
+		{name: "NoDsts", ports: []tailcfg.PortRange{ssh}, want: []tailcfg.FilterRule{}},
+		{
+			name:  "Ports",
+			dsts:  []netip.Addr{self},
+			ports: []tailcfg.PortRange{ssh, {First: 8080, Last: 8080}},
+			want: []tailcfg.FilterRule{{
+				SrcIPs:  []string{"*"},
+				IPProto: []int{int(ipproto.TCP)},
+				DstPorts: []tailcfg.NetPortRange{
+					{IP: "fd7a:115c:a1e0::1", Ports: ssh},
+					{IP: "fd7a:115c:a1e0::1", Ports: tailcfg.PortRange{First: 8080, Last: 8080}},
+				},
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FilterAllowTCPPorts(tc.dsts, tc.ports...)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got rules %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFilterAllowRoutes(t *testing.T) {
+	lan := netip.MustParsePrefix("10.0.0.0/24")
+	alice := netip.MustParseAddr("100.64.0.2")
+
+	for _, tc := range []struct {
+		name   string
+		routes []netip.Prefix
+		srcs   []netip.Addr
+		ports  []tailcfg.PortRange
+		want   []tailcfg.FilterRule
+	}{
+		{name: "NoRoutes", srcs: []netip.Addr{alice}, want: []tailcfg.FilterRule{}},
+		{name: "NoSrcs", routes: []netip.Prefix{lan}, want: []tailcfg.FilterRule{}},
+		{
+			name:   "AnyPort",
+			routes: []netip.Prefix{lan},
+			srcs:   []netip.Addr{alice},
+			want: []tailcfg.FilterRule{{
+				SrcIPs:   []string{"100.64.0.2"},
+				IPProto:  []int{int(ipproto.TCP)},
+				DstPorts: []tailcfg.NetPortRange{{IP: "10.0.0.0/24", Ports: tailcfg.PortRangeAny}},
+			}},
+		},
+		{
+			name:   "Ports",
+			routes: []netip.Prefix{lan},
+			srcs:   []netip.Addr{alice},
+			ports:  []tailcfg.PortRange{{First: 22, Last: 22}},
+			want: []tailcfg.FilterRule{{
+				SrcIPs:   []string{"100.64.0.2"},
+				IPProto:  []int{int(ipproto.TCP)},
+				DstPorts: []tailcfg.NetPortRange{{IP: "10.0.0.0/24", Ports: tailcfg.PortRange{First: 22, Last: 22}}},
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FilterAllowRoutes(tc.routes, tc.srcs, tc.ports...)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got rules %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	s := &server{
+		peerMap:   xsync.NewMapOf[key.NodePublic, *tailcfg.Node](),
+		peerNames: map[tailcfg.NodeID]string{},
+	}
+	for i, addr := range []string{"100.64.0.2", "100.64.0.3"} {
+		s.storePeer(&tailcfg.Node{
+			ID:        tailcfg.NodeID(i + 1),
+			Key:       key.NewNode().Public(),
+			Name:      "alice-laptop",
+			Addresses: []netip.Prefix{netip.PrefixFrom(netip.MustParseAddr(addr), 32)},
+		})
+	}
+	cfg := dnsConfig(s.peers())
+
+	if _, ok := cfg.Routes[MagicDNSSuffix]; !ok {
+		t.Fatalf("no route for %s in %v", MagicDNSSuffix, cfg.Routes)
+	}
+	resolve := func(name string) []string {
+		var addrs []string
+		for _, rec := range cfg.ExtraRecords {
+			if rec.Name == name {
+				addrs = append(addrs, rec.Value)
+			}
+		}
+		return addrs
+	}
+
+	for _, tc := range []struct {
+		name string
+		want []string
+	}{
+		{name: "alice-laptop.wush.internal.", want: []string{"100.64.0.2"}},
+		// Peers that share a hostname are told apart by a number.
+		{name: "alice-laptop-2.wush.internal.", want: []string{"100.64.0.3"}},
+		{name: "bob.wush.internal."},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := resolve(tc.name); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("resolved to %v, want %v", got, tc.want)
+			}
+		})
+	}
+}